@@ -0,0 +1,338 @@
+package apns
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/asn1"
+  "encoding/binary"
+  "encoding/pem"
+  "errors"
+  "io"
+  "math/big"
+  "net"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "appengine"
+)
+
+// testECKey returns a fresh P-256 key.
+func testECKey(t *testing.T) *ecdsa.PrivateKey {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return key
+}
+
+// testCertDER returns a self-signed certificate for key, DER encoded.
+func testCertDER(t *testing.T, key crypto.Signer) []byte {
+  tmpl := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject:      pkix.Name{CommonName: "apns test"},
+    NotBefore:    time.Now().Add(-time.Hour),
+    NotAfter:     time.Now().Add(time.Hour),
+    DNSNames:     []string{"gateway.test"},
+  }
+  der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return der
+}
+
+// encodePEM encodes b as a single PEM block of the given type.
+func encodePEM(typ string, b []byte) []byte {
+  return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b})
+}
+
+// join concatenates PEM blocks into one file.
+func join(blocks ...[]byte) []byte {
+  var out []byte
+  for _, b := range blocks {
+    out = append(out, b...)
+  }
+  return out
+}
+
+func TestLoadPemEC(t *testing.T) {
+  key := testECKey(t)
+  cert := encodePEM("CERTIFICATE", testCertDER(t, key))
+  sec1, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // openssl ecparam -genkey writes the curve before the key.
+  params, err := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+  if err != nil {
+    t.Fatal(err)
+  }
+  ecKey := join(encodePEM("EC PARAMETERS", params), encodePEM("EC PRIVATE KEY", sec1))
+
+  tests := []struct {
+    name string
+    pem  []byte
+  }{
+    {"sec1 cert first", join(cert, ecKey)},
+    {"sec1 key first", join(ecKey, cert)},
+    {"pkcs8", join(cert, encodePEM("PRIVATE KEY", pkcs8))},
+  }
+  for _, tt := range tests {
+    c, err := LoadPem(tt.pem, "")
+    if err != nil {
+      t.Errorf("%s: %v", tt.name, err)
+      continue
+    }
+    if priv, ok := c.PrivateKey.(*ecdsa.PrivateKey); !ok || !priv.Equal(key) {
+      t.Errorf("%s: got private key %T, want the EC key", tt.name, c.PrivateKey)
+    }
+  }
+
+  other, err := x509.MarshalECPrivateKey(testECKey(t))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := LoadPem(join(cert, encodePEM("EC PRIVATE KEY", other)), ""); !errors.Is(err, ErrKeyMismatch) {
+    t.Errorf("mismatched key: got %v, want ErrKeyMismatch", err)
+  }
+}
+
+// testContext is an appengine.Context that logs to the test.
+type testContext struct {
+  t *testing.T
+}
+
+func (c testContext) Debugf(format string, args ...interface{})    { c.t.Logf(format, args...) }
+func (c testContext) Infof(format string, args ...interface{})     { c.t.Logf(format, args...) }
+func (c testContext) Warningf(format string, args ...interface{})  { c.t.Logf(format, args...) }
+func (c testContext) Errorf(format string, args ...interface{})    { c.t.Logf(format, args...) }
+func (c testContext) Criticalf(format string, args ...interface{}) { c.t.Logf(format, args...) }
+
+// testPem returns a fresh self-signed certificate and its key as one PEM
+// file, so every client built from it gets a pool of its own.
+func testPem(t *testing.T) []byte {
+  key := testECKey(t)
+  der, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return join(encodePEM("CERTIFICATE", testCertDER(t, key)), encodePEM("EC PRIVATE KEY", der))
+}
+
+// newTestClient returns a client with a certificate of its own, whose pool
+// is closed when the test ends.
+func newTestClient(t *testing.T) *APNSClient {
+  a := &APNSClient{Ctx: testContext{t}, PemBytes: testPem(t), Gateway: "gateway.test:2195"}
+  t.Cleanup(func() { a.Close() })
+  return a
+}
+
+func TestSendFailsFastOnExhaustedPool(t *testing.T) {
+  a := newTestClient(t)
+  a.PoolSize = 1
+  a.PoolWaitTimeout = 10 * time.Millisecond
+  p, err := a.Pool()
+  if err != nil {
+    t.Fatal(err)
+  }
+  conn := p.Get()
+  defer p.Release(conn)
+
+  n := NewPushNotificationTo(strings.Repeat("ab", deviceTokenLength)).SetAlert("hi")
+  start := time.Now()
+  if err := a.Send(n); !errors.Is(err, ErrPoolExhausted) {
+    t.Fatalf("got %v, want ErrPoolExhausted", err)
+  }
+  if elapsed := time.Since(start); elapsed > time.Second {
+    t.Errorf("Send waited %v for a connection", elapsed)
+  }
+}
+
+func TestHandshakeRetriesDefault(t *testing.T) {
+  for _, tt := range []struct {
+    retries int
+    ok      bool
+  }{{0, true}, {1, true}, {-1, false}} {
+    a := newTestClient(t)
+    a.HandshakeRetries = tt.retries
+    newFakeGateway(t, a, serveSilently)
+    // The first handshake is cut off by the gateway closing the socket.
+    var dials int32
+    dial := a.Dialer
+    a.Dialer = func(ctx appengine.Context, network, addr string) (net.Conn, error) {
+      if atomic.AddInt32(&dials, 1) > 1 {
+        return dial(ctx, network, addr)
+      }
+      client, server := net.Pipe()
+      go func() {
+        server.Read(make([]byte, 64<<10))
+        server.Close()
+      }()
+      return client, nil
+    }
+
+    conn, err := newAPNSConn(a)
+    if err != nil {
+      t.Fatal(err)
+    }
+    err = conn.connect(a.Ctx)
+    if (err == nil) != tt.ok {
+      t.Errorf("HandshakeRetries %d: got %v after %d dials", tt.retries, err, dials)
+    }
+    conn.Close()
+  }
+}
+
+// pipeConn returns a connected APNSConn whose TLS session runs over a
+// net.Pipe, and the gateway's side of it.
+func pipeConn(t *testing.T) (*APNSConn, *tls.Conn) {
+  cert, err := LoadPem(testPem(t), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  client, server := net.Pipe()
+  t.Cleanup(func() {
+    client.Close()
+    server.Close()
+  })
+  gateway := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+  c := &APNSConn{
+    ReadTimeout: 50 * time.Millisecond,
+    TlsConn:     tls.Client(client, &tls.Config{InsecureSkipVerify: true}),
+    netConn:     client,
+  }
+  handshake := make(chan error, 1)
+  go func() { handshake <- gateway.Handshake() }()
+  if err := c.TlsConn.Handshake(); err != nil {
+    t.Fatal(err)
+  }
+  if err := <-handshake; err != nil {
+    t.Fatal(err)
+  }
+  c.Connected = true
+  return c, gateway
+}
+
+func TestReadResponseInChunks(t *testing.T) {
+  c, gateway := pipeConn(t)
+  resp := []byte{8, 8, 0, 0, 0x12, 0x34}
+  go func() {
+    // Each write is a TLS record of its own, read separately.
+    gateway.Write(resp[:2])
+    gateway.Write(resp[2:])
+  }()
+
+  read, err := c.readResponse(testContext{t}, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if status, identifier := read[1], binary.BigEndian.Uint32(read[2:6]); status != 8 || identifier != 0x1234 {
+    t.Errorf("decoded status %d, identifier %#x, want 8, 0x1234", status, identifier)
+  }
+}
+
+func TestReadResponseCutShort(t *testing.T) {
+  c, gateway := pipeConn(t)
+  go gateway.Write([]byte{8, 8, 0})
+
+  // A response cut short must not pass for the silence that means
+  // success.
+  if _, err := c.readResponse(testContext{t}, 0); err != io.ErrUnexpectedEOF {
+    t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+  }
+}
+
+func TestLoadPemKeyFirst(t *testing.T) {
+  key, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatal(err)
+  }
+  keyPEM := encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+  certPEM := encodePEM("CERTIFICATE", testCertDER(t, key))
+
+  c, err := LoadPem(join(keyPEM, certPEM), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(c.Certificate) != 1 {
+    t.Errorf("got %d certificates, want 1", len(c.Certificate))
+  }
+  if priv, ok := c.PrivateKey.(*rsa.PrivateKey); !ok || !priv.Equal(key) {
+    t.Errorf("got private key %T, want the RSA key", c.PrivateKey)
+  }
+}
+
+func TestLoadPemEncryptedAndPlaintextKeys(t *testing.T) {
+  key := testECKey(t)
+  certPEM := encodePEM("CERTIFICATE", testCertDER(t, key))
+  der, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  encrypted, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte("secret"), x509.PEMCipherAES256)
+  if err != nil {
+    t.Fatal(err)
+  }
+  encryptedPEM := join(certPEM, pem.EncodeToMemory(encrypted))
+  plaintextPEM := join(certPEM, encodePEM("EC PRIVATE KEY", der))
+
+  if _, err := LoadPem(encryptedPEM, "secret"); err != nil {
+    t.Errorf("encrypted key: %v", err)
+  }
+  if _, err := LoadPem(encryptedPEM, "wrong"); !errors.Is(err, ErrBadPassphrase) {
+    t.Errorf("encrypted key with the wrong passphrase: got %v, want ErrBadPassphrase", err)
+  }
+  // A plaintext key loads whatever passphrase the client is configured
+  // with.
+  for _, passphrase := range []string{"", "secret"} {
+    if _, err := LoadPem(plaintextPEM, passphrase); err != nil {
+      t.Errorf("plaintext key with passphrase %q: %v", passphrase, err)
+    }
+  }
+}
+
+func TestTLSConfigMinVersion(t *testing.T) {
+  a := newTestClient(t)
+  a.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS13, InsecureSkipVerify: true}
+  a.HandshakeRetries = -1
+  cert, err := LoadPem(testPem(t), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  // The gateway only speaks TLS 1.2.
+  a.Dialer = func(ctx appengine.Context, network, addr string) (net.Conn, error) {
+    client, server := net.Pipe()
+    go func() {
+      defer server.Close()
+      tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}).Handshake()
+    }()
+    return client, nil
+  }
+
+  conn, err := newAPNSConn(a)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if conn.TlsCfg.MinVersion != tls.VersionTLS13 {
+    t.Errorf("got MinVersion %#x, want TLS 1.3", conn.TlsCfg.MinVersion)
+  }
+  if len(conn.TlsCfg.Certificates) != 1 || conn.TlsCfg.ServerName != "gateway.test" {
+    t.Errorf("got %d certificates and ServerName %q, want the client's and the gateway host", len(conn.TlsCfg.Certificates), conn.TlsCfg.ServerName)
+  }
+  if err := conn.connect(a.Ctx); err == nil {
+    conn.Close()
+    t.Error("connected to a TLS 1.2 gateway despite MinVersion TLS 1.3")
+  }
+}
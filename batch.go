@@ -0,0 +1,285 @@
+package apns
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "strconv"
+
+  "appengine"
+)
+
+// IdentifierFunc assigns the identifier of the notification at index in a
+// batch. Identifiers must be unique within the batch, since Apple reports
+// failures by identifier.
+type IdentifierFunc func(n *PushNotification, index int) int32
+
+// BatchFailure is the notification APNs rejected within a batch.
+type BatchFailure struct {
+  Identifier   int32
+  Status       uint8
+  Notification *PushNotification
+}
+
+// apnsError returns the rejection as an *APNSError.
+func (f BatchFailure) apnsError() *APNSError {
+  return &APNSError{Status: f.Status, Message: StatusMessage(f.Status), Identifier: f.Identifier, Token: redactToken(f.Notification.DeviceToken)}
+}
+
+// BatchResult partitions a batch the way the binary protocol reports it.
+// Apple answers a pipelined batch with at most one error response, naming
+// the identifier it rejected, and silently drops everything written after
+// it on the same connection.
+type BatchResult struct {
+  // Delivered holds the notifications Apple accepted.
+  Delivered []*PushNotification
+  // Failed holds the notifications Apple rejected.
+  Failed []BatchFailure
+  // Pending holds the notifications that may not have arrived because the
+  // connection kept failing. They must be resent.
+  Pending []*PushNotification
+}
+
+// Err returns nil if no notification was rejected, or else an error
+// joining one *APNSError per rejection, annotated with the redacted device
+// token and identifier. Use errors.As to recover the individual statuses.
+func (r *BatchResult) Err() error {
+  errs := make([]error, 0, len(r.Failed))
+  for _, f := range r.Failed {
+    apnsErr := f.apnsError()
+    errs = append(errs, fmt.Errorf("token %s (identifier %d): %w", apnsErr.Token, f.Identifier, apnsErr))
+  }
+  return errors.Join(errs...)
+}
+
+// SendBatch writes notifications in order over a single pooled connection
+// and reports which of them were delivered, rejected or dropped.
+//
+// Because Apple drops everything written after a rejected notification,
+// the notifications following a rejection are resubmitted until the whole
+// batch has been delivered or rejected. The same happens when the
+// connection fails mid-stream, up to MaxRetries times; if it keeps
+// failing, the error is returned and the notifications that may not have
+// arrived are left in Pending.
+//
+// Each notification's Identifier is overwritten on every submission using
+// the client's IdentifierFunc, or taken from the client's identifier
+// counter if none is set.
+//
+// A rejection is reported in the result rather than as an error.
+func (a *APNSClient) SendBatch(notifications []*PushNotification) (*BatchResult, error) {
+  return a.sendBatch(a.Ctx, notifications, 0)
+}
+
+// sendBatch is SendBatch using ctx for the connection. offset is the
+// index of notifications[0] in the caller's batch, passed on to the
+// IdentifierFunc along with the rest of each notification's index.
+func (a *APNSClient) sendBatch(ctx appengine.Context, notifications []*PushNotification, offset int) (*BatchResult, error) {
+  index := make(map[*PushNotification]int, len(notifications))
+  for i, n := range notifications {
+    index[n] = offset + i
+  }
+  result := &BatchResult{}
+  pending := notifications
+  failures := 0
+  for len(pending) > 0 {
+    res, err := a.sendBatchOnce(ctx, pending, index)
+    if res == nil {
+      if len(pending) == len(notifications) && failures == 0 {
+        return nil, err
+      }
+      result.Pending = pending
+      return result, err
+    }
+    result.Delivered = append(result.Delivered, res.Delivered...)
+    result.Failed = append(result.Failed, res.Failed...)
+    pending = res.Pending
+    if err != nil {
+      failures++
+      var connErr *ConnectError
+      permanent := errors.As(err, &connErr) && !connErr.Temporary
+      if permanent || failures >= a.maxRetries() {
+        result.Pending = pending
+        return result, err
+      }
+    }
+  }
+  return result, nil
+}
+
+// sendBatchOnce writes notifications over one connection and partitions
+// them according to Apple's response, without resending. index holds each
+// notification's index in the caller's batch, which a resubmission doesn't
+// start at.
+func (a *APNSClient) sendBatchOnce(ctx appengine.Context, notifications []*PushNotification, index map[*PushNotification]int) (*BatchResult, error) {
+  identify := a.IdentifierFunc
+  if identify == nil {
+    identify = func(*PushNotification, int) int32 {
+      return a.NextIdentifier()
+    }
+  }
+
+  seen := make(map[int32]bool, len(notifications))
+  frames := make([][]byte, len(notifications))
+  var err error
+  for i, n := range notifications {
+    if n.mixedSilent() && a.SilentPolicy != SilentAllow {
+      return nil, sendError(n, ErrMixedSilentPush)
+    }
+    a.applyDefaults(n)
+    n.Identifier = identify(n, index[n])
+    if seen[n.Identifier] {
+      return nil, errors.New("duplicate identifier in batch: " + strconv.Itoa(int(n.Identifier)))
+    }
+    seen[n.Identifier] = true
+    frames[i], _, err = n.toBytes()
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  if a.DryRun {
+    if a.OnDryRun != nil {
+      for i, n := range notifications {
+        a.OnDryRun(n, frames[i])
+      }
+    }
+    return &BatchResult{Delivered: notifications}, nil
+  }
+
+  p, err := initPool(a)
+  if err != nil {
+    return nil, err
+  }
+  conn, err := p.getWithin(ctx, a.poolWaitTimeout())
+  if err != nil {
+    return nil, err
+  }
+  defer p.release(ctx, conn)
+
+  if !a.AllowEnvironmentMismatch {
+    for _, n := range notifications {
+      if !conn.env.covers(n.Environment) {
+        return nil, fmt.Errorf("apns: notification is for %s but the certificate is %s only", n.Environment, conn.env)
+      }
+    }
+  }
+
+  result := &BatchResult{}
+  err = conn.connect(ctx)
+  if err != nil {
+    result.Pending = notifications
+    return result, err
+  }
+
+  for i, frame := range frames {
+    if err = conn.write(ctx, frame, a.writeTimeout()); err != nil {
+      conn.Connected = false
+      // The usual reason is Apple closing the connection after rejecting
+      // an earlier frame, so look for its response before assuming the
+      // frames already written arrived.
+      if i > 0 {
+        if reads, rerr := conn.readResponses(ctx, a.readTimeout()); rerr == nil {
+          return a.partition(ctx, p, conn, notifications, i, reads)
+        }
+      }
+      result.Delivered = notifications[:i]
+      result.Pending = notifications[i:]
+      return result, err
+    }
+  }
+
+  // Apple never answers the simple format, so a batch of nothing else can
+  // only be assumed delivered.
+  simple := true
+  for _, n := range notifications {
+    simple = simple && n.Format == FormatSimple
+  }
+  if simple {
+    result.Delivered = notifications
+    return result, nil
+  }
+
+  reads, err := conn.readResponses(ctx, a.readTimeout())
+  if err != nil {
+    if isReadTimeout(err) {
+      result.Delivered = notifications
+      return result, nil
+    }
+    conn.Connected = false
+    result.Pending = notifications
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+      err = errors.New("Connection closed")
+    }
+    return result, err
+  }
+
+  return a.partition(ctx, p, conn, notifications, len(notifications), reads)
+}
+
+// partition splits notifications, of which the first written were written
+// to conn, according to Apple's responses to them.
+func (a *APNSClient) partition(ctx appengine.Context, p *APNSPool, conn *APNSConn, notifications []*PushNotification, written int, reads [][6]byte) (*BatchResult, error) {
+  for _, read := range reads {
+    a.logResponse(ctx, read)
+  }
+  result := &BatchResult{}
+  read := reads[0]
+  // Apple closes the connection after any error response.
+  conn.Connected = false
+  status := read[1]
+  identifier := int32(binary.BigEndian.Uint32(read[2:6]))
+  if status == 0 {
+    if a.OnDelivered != nil {
+      a.OnDelivered(identifier)
+    }
+    result.Delivered = notifications[:written]
+    result.Pending = notifications[written:]
+    return result, nil
+  }
+
+  idx := -1
+  for i, n := range notifications[:written] {
+    if n.Identifier == identifier {
+      idx = i
+      break
+    }
+  }
+  if idx < 0 {
+    result.Pending = notifications
+    return result, errors.New("APNS reported unknown identifier in batch response")
+  }
+
+  // On shutdown the identifier is the last notification Apple accepted.
+  if status == 10 {
+    p.noteShutdown(conn)
+    result.Delivered = notifications[:idx+1]
+    result.Pending = notifications[idx+1:]
+    return result, nil
+  }
+
+  result.Delivered = notifications[:idx]
+  result.Failed = []BatchFailure{{Identifier: identifier, Status: status, Notification: notifications[idx]}}
+  result.Pending = notifications[idx+1:]
+  for _, read := range reads[1:] {
+    result.reject(read[1], int32(binary.BigEndian.Uint32(read[2:6])))
+  }
+  return result, nil
+}
+
+// reject moves the pending notification with identifier to Failed, for a
+// further rejection reported after the first. Other responses are
+// ignored.
+func (r *BatchResult) reject(status uint8, identifier int32) {
+  if status == 0 || status == 10 {
+    return
+  }
+  for i, n := range r.Pending {
+    if n.Identifier == identifier {
+      r.Failed = append(r.Failed, BatchFailure{Identifier: identifier, Status: status, Notification: n})
+      r.Pending = append(r.Pending[:i:i], r.Pending[i+1:]...)
+      return
+    }
+  }
+}
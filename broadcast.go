@@ -0,0 +1,193 @@
+package apns
+
+import (
+  "errors"
+  "sync"
+
+  "appengine"
+)
+
+// defaultBroadcastChunkSize is the number of tokens sent per chunk when
+// BroadcastOptions.ChunkSize is unset.
+const defaultBroadcastChunkSize = 500
+
+// multiConns is the number of pooled connections SendMulti writes over in
+// parallel.
+const multiConns = 4
+
+// BroadcastProgress reports how far a broadcast has got.
+type BroadcastProgress struct {
+  Sent      int
+  Failed    int
+  Remaining int
+  // Offset is the index of the next token to send. Pass it back as
+  // BroadcastOptions.Offset to resume an interrupted broadcast.
+  Offset    int
+}
+
+// BroadcastOptions configures Broadcast.
+type BroadcastOptions struct {
+  // ChunkSize is the number of tokens sent per chunk. Defaults to 500.
+  ChunkSize int
+  // Offset is the index of the first token to send, for resuming.
+  Offset    int
+  // Progress, if set, is called after every completed chunk.
+  Progress  func(BroadcastProgress)
+}
+
+// Broadcast sends the payload of template to every token, one chunk at a
+// time. Like SendMulti, the payload is validated and serialized once, and
+// each chunk is spread over several pooled connections and written with
+// SendBatch, so notifications dropped after a rejection are resent. Tokens
+// that aren't valid hex count as failed. It stops cleanly between chunks
+// when ctx is cancelled, or when a chunk can't be sent, and returns the
+// progress so far along with the error.
+//
+// Offset always points at a chunk boundary, so resuming after an error may
+// resend the part of the interrupted chunk that was delivered.
+func (a *APNSClient) Broadcast(ctx appengine.Context, template *PushNotification, tokens []string, opts BroadcastOptions) (BroadcastProgress, error) {
+  size := opts.ChunkSize
+  if size <= 0 {
+    size = defaultBroadcastChunkSize
+  }
+
+  progress := BroadcastProgress{Offset: opts.Offset, Remaining: len(tokens) - opts.Offset}
+  payload, err := a.compile(template)
+  if err != nil {
+    return progress, err
+  }
+  for progress.Offset < len(tokens) {
+    if err := contextErr(ctx); err != nil {
+      return progress, err
+    }
+
+    end := progress.Offset + size
+    if end > len(tokens) {
+      end = len(tokens)
+    }
+    chunk := addressed(template, payload, tokens[progress.Offset:end], func(string, error) {
+      progress.Failed++
+    })
+
+    var errs []error
+    a.spread(ctx, chunk, func(share []*PushNotification, res *BatchResult, err error) {
+      if err != nil {
+        errs = append(errs, err)
+      }
+      if res != nil {
+        progress.Sent += len(res.Delivered)
+        progress.Failed += len(res.Failed)
+      }
+    })
+    if err := errors.Join(errs...); err != nil {
+      return progress, err
+    }
+
+    progress.Offset = end
+    progress.Remaining = len(tokens) - end
+    if opts.Progress != nil {
+      opts.Progress(progress)
+    }
+  }
+  return progress, nil
+}
+
+// SendMulti sends the payload of n to every token and returns the tokens
+// that failed, mapped to their errors. The payload is validated and
+// serialized once; only the frame around it is built per token. The tokens
+// are split across a few pooled connections and written with SendBatch,
+// so Apple's rejections come back as *APNSError and the notifications
+// dropped after them are resent.
+func (a *APNSClient) SendMulti(tokens []string, n *PushNotification) map[string]error {
+  failed := map[string]error{}
+  payload, err := a.compile(n)
+  if err != nil {
+    for _, token := range tokens {
+      failed[token] = err
+    }
+    return failed
+  }
+
+  notifications := addressed(n, payload, tokens, func(token string, err error) {
+    failed[token] = err
+  })
+  a.spread(a.Ctx, notifications, func(share []*PushNotification, res *BatchResult, err error) {
+    if res == nil {
+      for _, c := range share {
+        failed[c.DeviceToken] = err
+      }
+      return
+    }
+    for _, f := range res.Failed {
+      failed[f.Notification.DeviceToken] = f.apnsError()
+    }
+    for _, c := range res.Pending {
+      failed[c.DeviceToken] = err
+    }
+  })
+  return failed
+}
+
+// compile validates the payload of n and serializes it once, with the
+// client's defaults applied, for sending to many tokens.
+func (a *APNSClient) compile(n *PushNotification) ([]byte, error) {
+  if aps, ok := n.Get("aps").(*Payload); ok {
+    if err := aps.validate(); err != nil {
+      return nil, err
+    }
+  }
+  if n.CollapseID != "" || n.Topic != "" {
+    return nil, ErrUnsupportedOnLegacy
+  }
+  if n.mixedSilent() && a.SilentPolicy != SilentAllow {
+    return nil, ErrMixedSilentPush
+  }
+  template := n.copyFor(n.DeviceToken)
+  a.applyDefaults(template)
+  payload, _, err := template.fittedPayloadJSON()
+  return payload, err
+}
+
+// addressed returns a copy of n carrying the compiled payload for each
+// token. Tokens that don't decode are passed to invalid instead.
+func addressed(n *PushNotification, payload []byte, tokens []string, invalid func(token string, err error)) []*PushNotification {
+  notifications := make([]*PushNotification, 0, len(tokens))
+  for _, token := range tokens {
+    if _, err := decodeToken(token); err != nil {
+      invalid(token, err)
+      continue
+    }
+    c := n.copyFor(token)
+    c.payload = payload
+    notifications = append(notifications, c)
+  }
+  return notifications
+}
+
+// spread splits notifications across up to multiConns pooled connections
+// and sends each share with SendBatch in parallel, passing it to done
+// along with its outcome. Calls to done are serialized. The IdentifierFunc
+// is passed each notification's index in notifications, not in its share.
+func (a *APNSClient) spread(ctx appengine.Context, notifications []*PushNotification, done func(share []*PushNotification, res *BatchResult, err error)) {
+  conns := multiConns
+  if conns > len(notifications) {
+    conns = len(notifications)
+  }
+  var (
+    wg sync.WaitGroup
+    mu sync.Mutex
+  )
+  for i := 0; i < conns; i++ {
+    offset := i * len(notifications) / conns
+    share := notifications[offset : (i+1)*len(notifications)/conns]
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      res, err := a.sendBatch(ctx, share, offset)
+      mu.Lock()
+      defer mu.Unlock()
+      done(share, res, err)
+    }()
+  }
+  wg.Wait()
+}
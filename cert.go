@@ -0,0 +1,119 @@
+package apns
+
+import (
+  "crypto/x509"
+  "encoding/asn1"
+  "errors"
+  "fmt"
+  "strings"
+  "time"
+)
+
+var (
+  // oidUID is the subject attribute Apple stores the bundle ID in.
+  oidUID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+  // oidDevelopment marks a certificate valid for the sandbox gateway.
+  oidDevelopment = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}
+  // oidProduction marks a certificate valid for the production gateway.
+  oidProduction = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 2}
+)
+
+// CertTopic returns the bundle ID an APNs certificate was issued for, or
+// an empty string if the certificate doesn't carry one.
+func CertTopic(cert *x509.Certificate) string {
+  for _, name := range cert.Subject.Names {
+    if name.Type.Equal(oidUID) {
+      if topic, ok := name.Value.(string); ok {
+        return topic
+      }
+    }
+  }
+  return ""
+}
+
+// CertEnvironment reports which APNs environment a certificate is valid
+// for, based on Apple's certificate extensions.
+func CertEnvironment(cert *x509.Certificate) Environment {
+  var dev, prod bool
+  for _, ext := range cert.Extensions {
+    switch {
+    case ext.Id.Equal(oidDevelopment):
+      dev = true
+    case ext.Id.Equal(oidProduction):
+      prod = true
+    }
+  }
+  switch {
+  case dev && prod:
+    return EnvironmentAny
+  case dev:
+    return EnvironmentSandbox
+  case prod:
+    return EnvironmentProduction
+  }
+  return EnvironmentUnknown
+}
+
+// checkCertValidity returns an error if now is outside the certificate's
+// validity window.
+func checkCertValidity(cert *x509.Certificate, now time.Time) error {
+  if now.Before(cert.NotBefore) {
+    return fmt.Errorf("certificate not valid before %s", cert.NotBefore.Format(time.RFC3339))
+  }
+  if now.After(cert.NotAfter) {
+    return fmt.Errorf("certificate expired on %s", cert.NotAfter.Format(time.RFC3339))
+  }
+  return nil
+}
+
+// VerifyOptions lists what VerifyPem checks beyond the file being loadable.
+// Zero values skip the corresponding check.
+type VerifyOptions struct {
+  // Environment is the gateway environment the certificate must cover.
+  Environment Environment
+  // Topic is the bundle ID the certificate must be issued for.
+  Topic string
+  // Now is the time the validity window is checked against. Defaults to
+  // the current time.
+  Now time.Time
+}
+
+// VerifyPem loads a certificate+key pem file and checks that it is within
+// its validity period and matches the expected environment and topic. All
+// problems found are reported together in the returned error.
+func VerifyPem(pemFile string, passphrase string, opts VerifyOptions) error {
+  crt, err := LoadPemFile(pemFile, passphrase)
+  if err != nil {
+    return err
+  }
+  cert, err := x509.ParseCertificate(crt.Certificate[0])
+  if err != nil {
+    return err
+  }
+
+  now := opts.Now
+  if now.IsZero() {
+    now = time.Now()
+  }
+
+  var problems []string
+  if err := checkCertValidity(cert, now); err != nil {
+    problems = append(problems, err.Error())
+  }
+  if opts.Environment != EnvironmentUnknown {
+    env := CertEnvironment(cert)
+    if env != opts.Environment && env != EnvironmentAny {
+      problems = append(problems, fmt.Sprintf("certificate environment is %s, want %s", env, opts.Environment))
+    }
+  }
+  if opts.Topic != "" {
+    if topic := CertTopic(cert); topic != opts.Topic {
+      problems = append(problems, fmt.Sprintf("certificate topic is %q, want %q", topic, opts.Topic))
+    }
+  }
+
+  if len(problems) > 0 {
+    return errors.New(pemFile + ": " + strings.Join(problems, "; "))
+  }
+  return nil
+}
@@ -1,14 +1,24 @@
 package apns
 
 import (
+  "encoding/binary"
   "errors"
+  "fmt"
+  "math/rand"
   "sync"
   "time"
   "io"
   "net"
+  "strings"
+  "crypto/tls"
+  "context"
+
+  "appengine"
 )
 
-// APNSStatusCodes are codes to message from apns.
+// APNSStatusCodes are codes to message from apns. Treat it as read-only:
+// use StatusMessage to look codes up and RegisterStatus to add them, so
+// sends in flight never race with a write.
 var APNSStatusCodes = map[uint8]string{
   0:   "No errors encountered",
   1:   "Processing error",
@@ -23,107 +33,733 @@ var APNSStatusCodes = map[uint8]string{
   255: "None (unknown)",
 }
 
+// APNSError is a status code Apple returned in an error response. When
+// Apple rejects a notification, the error returned by Send wraps an
+// *APNSError, which can be recovered with errors.As:
+//
+//   var apnsErr *apns.APNSError
+//   if errors.As(err, &apnsErr) && apnsErr.Status == 8 {
+//     // Invalid token: remove it.
+//   }
+type APNSError struct {
+  Status     uint8
+  Message    string
+  // Identifier names the notification Apple rejected, as reported in
+  // bytes 2-5 of the error response.
+  Identifier int32
+  // Token is the redacted device token of the rejected notification.
+  Token      string
+}
+
+func (e *APNSError) Error() string {
+  return e.Message
+}
+
+// Temporary reports whether the error is Apple shutting the connection
+// down (status 10) rather than rejecting the notification. Send resends on
+// a fresh connection in that case, so it only surfaces once the retries
+// are used up, and the notification itself may be sent again as is.
+func (e *APNSError) Temporary() bool {
+  return e.Status == 10
+}
+
+// StatusString returns the human-readable description of Status.
+func (e *APNSError) StatusString() string {
+  return StatusMessage(e.Status)
+}
+
+// StatusMessage describes status, including its number when it is
+// unknown. It is safe to call concurrently with RegisterStatus.
+func StatusMessage(status uint8) string {
+  statusMu.RLock()
+  msg, ok := APNSStatusCodes[status]
+  statusMu.RUnlock()
+  if ok {
+    return msg
+  }
+  return fmt.Sprintf("unknown APNS status: %d", status)
+}
+
+// RegisterStatus adds or replaces the description of a status code, e.g.
+// one Apple introduces after this package was written.
+func RegisterStatus(status uint8, msg string) {
+  statusMu.Lock()
+  APNSStatusCodes[status] = msg
+  statusMu.Unlock()
+}
+
+// statusMu guards APNSStatusCodes against RegisterStatus.
+var statusMu sync.RWMutex
+
 var (
-  apnsInitSync  sync.Once
-  pool          *APNSPool
+  // pools holds one pool per gateway and certificate, so sandbox and
+  // production clients in the same process don't share connections.
+  pools         = map[poolKey]*APNSPool{}
+  // poolMu guards pools.
+  poolMu        sync.Mutex
 )
 
-func (a *APNSClient) Send(n *PushNotification) error {
+// poolKey identifies the clients that can share a pool: those whose
+// connections would be set up the same way. Timeouts aren't part of it
+// since every send passes its client's own. Function and interface
+// fields can't be compared and come from the client that builds the pool.
+type poolKey struct {
+  gateway    string
+  pem        string
+  pemBytes   string
+  passphrase string
+
+  failover         string
+  proxy            string
+  tlsConfig        *tls.Config
+  deadlines        *DeadlinePolicy
+  handshakeRetries int
+  maxConnAge       time.Duration
+  failbackAfter    time.Duration
+}
+
+// poolKey returns the key of the pool a's sends go through.
+func (a *APNSClient) poolKey() poolKey {
+  key := poolKey{
+    gateway:          a.Gateway,
+    pem:              a.Pem,
+    pemBytes:         string(a.PemBytes),
+    passphrase:       a.Passphrase,
+    failover:         strings.Join(a.FailoverGateways, " "),
+    tlsConfig:        a.TLSConfig,
+    deadlines:        a.Deadlines,
+    handshakeRetries: a.handshakeRetries(),
+    maxConnAge:       a.MaxConnAge,
+    failbackAfter:    a.FailbackAfter,
+  }
+  if a.Proxy != nil {
+    key.proxy = a.Proxy.String()
+  }
+  return key
+}
+
+// SendResult describes how a notification was sent.
+type SendResult struct {
+  // ConnID is the ID of the pooled connection that made the last attempt,
+  // or 0 if the notification never reached a connection or was sent over
+  // one outside the pool.
+  ConnID int
+  // Trimmed is set when the alert body was shortened to fit the payload
+  // size limit.
+  Trimmed bool
+  // Frame is the serialized notification written to the gateway. It is
+  // only filled in by Validate and in DryRun mode.
+  Frame   []byte
+  // Confirmed is set when Apple explicitly answered with status 0, or
+  // named the notification as the last one it accepted before shutting
+  // the connection down, rather than staying silent until the read timed
+  // out.
+  Confirmed bool
+}
+
+// Validate runs every step of Send short of the network: client defaults
+// and the silent push policy are applied, then the token is decoded and
+// the payload serialized, size-checked and framed. The pool is never
+// touched, which makes it suitable for unit tests asserting on the exact
+// bytes a notification produces. Unlike Send, n.Identifier is left as is
+// so frames are reproducible.
+func (a *APNSClient) Validate(n *PushNotification) (*SendResult, error) {
+  if n.mixedSilent() && a.SilentPolicy == SilentReject {
+    return &SendResult{}, ErrMixedSilentPush
+  }
+  a.applyDefaults(n)
+
+  res := &SendResult{}
   var err error
-  apnsInitSync.Do(func() {
-    pool, err = newAPNSPool(a.Gateway, a.Pem, a.Passphrase)
-  })
+  res.Frame, res.Trimmed, err = n.toBytes()
+  return res, err
+}
+
+// Metrics observes send attempts, e.g. to export their latency to a
+// monitoring system.
+type Metrics interface {
+  // ObserveSend is called at the end of every send attempt with the time
+  // from writing the notification to Apple's response or the read
+  // timeout, the status Apple answered with (0 when it stayed silent) and
+  // the attempt's error, if any.
+  ObserveSend(duration time.Duration, status uint8, err error)
+}
+
+// Sender sends push notifications. *APNSClient implements it; code that
+// depends on Sender rather than the client can be tested with a fake.
+type Sender interface {
+  Send(n *PushNotification) error
+}
+
+var _ Sender = (*APNSClient)(nil)
+
+// Send delivers n over a pooled connection, retrying on failure until
+// n.RetryCount is exhausted. A notification with no RetryCount set gets
+// the client's MaxRetries. Only failures a resend can fix are retried: a
+// processing error, a shutdown or a dropped connection. Apple rejecting
+// the notification itself, e.g. for an invalid token, is returned at
+// once. n.Identifier is assigned from the client's identifier counter.
+func (a *APNSClient) Send(n *PushNotification) error {
+  return a.SendCtx(a.Ctx, n)
+}
+
+// SendCtx is like Send but connects and logs through ctx instead of the
+// client's Ctx. On App Engine every request has its own context, so a
+// client that outlives the request that created it should send with the
+// current request's context.
+func (a *APNSClient) SendCtx(ctx appengine.Context, n *PushNotification) error {
+  _, err := a.deliver(ctx, n, 0)
+  return err
+}
+
+// ErrMixedSilentPush is returned under SilentReject for a content-available
+// notification that also has an alert or sound.
+var ErrMixedSilentPush = errors.New("apns: content-available push must not have an alert or sound")
+
+// Deliver is like Send but also reports how the notification was sent.
+func (a *APNSClient) Deliver(n *PushNotification) (*SendResult, error) {
+  return a.deliver(a.Ctx, n, 0)
+}
+
+// deliver is Deliver through ctx, waiting up to wait for Apple's response,
+// or the client's ReadTimeout if wait is zero.
+func (a *APNSClient) deliver(ctx appengine.Context, n *PushNotification, wait time.Duration) (*SendResult, error) {
+  if n.mixedSilent() {
+    switch a.SilentPolicy {
+    case SilentReject:
+      return &SendResult{}, sendError(n, ErrMixedSilentPush)
+    case SilentSplit:
+      visible, silent := n.splitSilent()
+      if res, err := a.deliver(ctx, visible, wait); err != nil {
+        return res, err
+      }
+      return a.deliver(ctx, silent, wait)
+    }
+  }
+
+  if n.RetryCount <= 0 {
+    n.RetryCount = a.maxRetries()
+  }
+  n.attempts = n.RetryCount
+  if wait <= 0 {
+    wait = a.readTimeout()
+  }
+  n.wait = wait
+  a.applyDefaults(n)
+  n.Identifier = a.NextIdentifier()
+  n.frame = nil
+  res := &SendResult{}
+  if a.DryRun {
+    var err error
+    res.Frame, res.Trimmed, err = n.toBytes()
+    if err == nil && a.OnDryRun != nil {
+      a.OnDryRun(n, res.Frame)
+    }
+    return res, sendError(n, err)
+  }
+  // send sets n.Conn to retry over the same connection; don't leave a
+  // pooled connection pinned to n once it has been released.
+  pinned := n.Conn
+  err := a.send(ctx, n, res)
+  n.Conn = pinned
+  if err != nil && a.DebugOnFailure {
+    a.logFailure(ctx, n, err)
+  }
+  return res, sendError(n, err)
+}
+
+// sendError annotates an error sending n with its redacted device token,
+// so the failures of concurrent sends can be told apart in logs. The
+// cause is wrapped for errors.Is and errors.As.
+func sendError(n *PushNotification, err error) error {
+  if err == nil {
+    return nil
+  }
+  return fmt.Errorf("apns: send to %s: %w", redactToken(n.DeviceToken), err)
+}
+
+// SendRaw sends payload, already serialized as JSON, to the device with
+// the hex token, for payloads built by other tools or replayed from
+// captures. It is framed and sent over a pooled connection like Send,
+// including reading Apple's error response, but the payload is written as
+// is: only its size is checked, against MaxPayloadBytes.
+func (a *APNSClient) SendRaw(token string, payload []byte) error {
+  if len(payload) == 0 {
+    return errors.New("payload is empty")
+  }
+  n := NewPushNotificationTo(token)
+  n.payload = payload
+  return a.Send(n)
+}
+
+// SendAndWait is Send waiting up to wait for Apple's response instead of
+// ReadTimeout, for a single notification that deserves more certainty
+// without changing the whole client. Like Send it returns nil if Apple
+// stays silent, and an error wrapping *APNSError on rejection.
+func (a *APNSClient) SendAndWait(n *PushNotification, wait time.Duration) error {
+  _, err := a.deliver(a.Ctx, n, wait)
+  return err
+}
+
+// SyncResult is the outcome of SendSync.
+type SyncResult int
+
+const (
+  // SyncUnknown means Apple did not answer before SyncTimeout, the send
+  // failed before Apple could, or Apple kept failing on its side with a
+  // processing error or shutdown. Silence is how the binary protocol
+  // signals success, so the notification was most likely delivered, but
+  // it is not certain.
+  SyncUnknown SyncResult = iota
+  // SyncDelivered means Apple acknowledged the notification.
+  SyncDelivered
+  // SyncRejected means Apple rejected the notification itself with a
+  // status from 2 to 8; the error wraps the *APNSError with the status.
+  SyncRejected
+)
+
+func (r SyncResult) String() string {
+  switch r {
+  case SyncDelivered:
+    return "delivered"
+  case SyncRejected:
+    return "rejected"
+  }
+  return "unknown"
+}
+
+// SendSync is like Send but waits up to SyncTimeout instead of ReadTimeout
+// for Apple's response, and reports whether the notification was
+// delivered, rejected or left unknown, so callers can decide whether to
+// persist it for a later retry. Send remains the fast path for
+// fire-and-forget use.
+func (a *APNSClient) SendSync(n *PushNotification) (SyncResult, error) {
+  wait := a.SyncTimeout
+  if wait <= 0 {
+    wait = defaultSyncTimeout
+  }
+  res, err := a.deliver(a.Ctx, n, wait)
+
+  var apnsErr *APNSError
+  switch {
+  case err == nil && res.Confirmed:
+    return SyncDelivered, nil
+  case errors.As(err, &apnsErr) && apnsErr.Status >= 2 && apnsErr.Status <= 8:
+    return SyncRejected, err
+  }
+  return SyncUnknown, err
+}
+
+// SendAuto sends n through primary and, if Apple rejects the device token,
+// sends it again through fallback. It is meant for cleaning up token stores
+// where the environment of a token was never recorded: point primary at
+// production and fallback at sandbox (or vice versa). When a send succeeds,
+// found is called with the token and the environment that accepted it so
+// the caller can persist it.
+//
+// This is opt-in and costly: a mismatched token pays for a full failed send
+// on primary before the fallback is attempted. Each client sends through
+// its own pool, since their gateways differ. Rejections that arrive after
+// the read timeout look like success and are not detected.
+func SendAuto(primary, fallback *APNSClient, n *PushNotification, found func(token string, env Environment)) error {
+  retries := n.RetryCount
+  err := primary.Send(n)
+  if err == nil {
+    if found != nil {
+      found(n.DeviceToken, primary.Environment())
+    }
+    return nil
+  }
+  if !tokenRejected(n) {
+    return err
+  }
+
+  n.RetryCount = retries
+  n.Error = nil
+  if err = fallback.Send(n); err != nil {
+    return err
+  }
+  if found != nil {
+    found(n.DeviceToken, fallback.Environment())
+  }
+  return nil
+}
+
+// tokenRejected reports whether the last error recorded on n is Apple
+// rejecting the device token, which is how an environment mismatch shows
+// up on the binary protocol.
+func tokenRejected(n *PushNotification) bool {
+  var apnsErr *APNSError
+  return errors.As(n.Error, &apnsErr) && apnsErr.Status == 8
+}
+
+// send is the recursive body of Send.
+func (a *APNSClient) send(ctx appengine.Context, n *PushNotification, res *SendResult) error {
+  p, err := initPool(a)
   if err != nil {
     return err
   }
 
+  if err = contextErr(ctx); err != nil {
+    return err
+  }
+
   if n.RetryCount <= 0 {
-    return errors.New("Retried more than 3 times: " + n.Error.Error())
+    if n.Error == nil {
+      return fmt.Errorf("Retried more than %d times", n.attempts)
+    }
+    return fmt.Errorf("Retried more than %d times: %w", n.attempts, n.Error)
   } else {
+    if consumed := n.attempts - n.RetryCount; consumed > 0 {
+      if err = a.backoff(ctx, consumed); err != nil {
+        return err
+      }
+    }
     n.RetryCount--
     if n.RetryCount < 2 {
-      a.Ctx.Infof("Retry count: %i", n.RetryCount)
+      a.logger(ctx).Infof("Retry count for %s: %d", redactToken(n.DeviceToken), n.RetryCount)
     }
   }
 
   var conn *APNSConn
   if n.Conn == nil {
-    conn = pool.Get()
-    defer pool.Release(conn)
+    conn, err = p.getWithin(ctx, a.poolWaitTimeout())
+    if err != nil {
+      return err
+    }
+    defer p.release(ctx, conn)
   } else {
     conn = n.Conn
   }
+  res.ConnID = conn.ID
+
+  if !a.AllowEnvironmentMismatch && !conn.env.covers(n.Environment) {
+    return fmt.Errorf("apns: notification is for %s but the certificate is %s only", n.Environment, conn.env)
+  }
+
+  if a.PingBeforeSend && conn.Connected {
+    if err := conn.Ping(ctx); err != nil {
+      a.logger(ctx).Infof("APNS connection %d failed ping, redialing: %v", conn.ID, err)
+    }
+  }
 
-  err = conn.connect(a.Ctx)
+  err = conn.connect(ctx)
   if err != nil {
+    var connErr *ConnectError
+    if errors.As(err, &connErr) && connErr.Temporary {
+      n.Error = err
+      n.Conn = conn
+      return a.send(ctx, n, res)
+    }
     return err
   }
 
-  payload, err := n.ToBytes()
-	if err != nil {
-    a.Ctx.Infof("APNS error parsing payload %s", err.Error())
-    return err
+  if n.frame == nil {
+    n.frame, res.Trimmed, err = n.toBytes()
+    if err != nil {
+      a.logger(ctx).Infof("APNS error parsing payload for %s: %s", redactToken(n.DeviceToken), err.Error())
+      return err
+    }
   }
 
-  _, err = conn.TlsConn.Write(payload)
+  start := time.Now()
+  err = conn.write(ctx, n.frame, a.writeTimeout())
   if err != nil {
+    a.observe(start, 0, err)
     conn.Connected = false
     n.Error = err
     n.Conn = conn
-    return a.Send(n)
+    return a.send(ctx, n, res)
   }
 
-  conn.TlsConn.SetReadDeadline(time.Now().Add(conn.ReadTimeout))
-  read := [6]byte{}
-  r, err := conn.TlsConn.Read(read[:])
+  if n.Format == FormatSimple {
+    // Apple never answers the simple format.
+    a.observe(start, 0, nil)
+    return nil
+  }
+
+  read, err := conn.readResponse(ctx, n.wait)
   if err != nil {
-    if err2, ok := err.(net.Error); ok && err2.Timeout() {
+    if isReadTimeout(err) {
       // Success, apns doesn't usually return a response if successful.
       // Only issue is, is timeout length long enough (150ms) for err response.
+      a.observe(start, 0, nil)
       return nil
     }
+    a.observe(start, 0, err)
 
-    if err.Error() == "API error 1 (remote_socket: SYSTEM_ERROR): system_error:35 error_detail:\"Resource temporarily unavailable\"" {
-      a.Ctx.Infof("Resource temporarily unavailable")
-      return nil
-    }
-
-    if err == io.EOF {
-      conn.Connected = false
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+      // Close rather than just mark the connection, so the retry dials a
+      // fresh socket instead of reusing the dead one.
+      conn.Close()
       n.Error = errors.New("Connection closed")
       n.Conn = conn
-      return a.Send(n)
+      return a.send(ctx, n, res)
     }
 
     return err
   }
 
-  if r >= 0 {
-    status := uint8(read[1])
-    switch status {
-    case 0:
-      return nil
-    case 1, 2, 3, 4, 5, 6, 7, 8:
-      //1:   "Processing error"
-      //2:   "Missing Device Token",
-      //3:   "Missing Topic",
-      //4:   "Missing Payload",
-      //5:   "Invalid Token Size",
-      //6:   "Invalid Topic Size",
-      //7:   "Invalid Payload Size",
-      //8:   "Invalid Token",
-      conn.Connected = false
-      n.Error = errors.New(APNSStatusCodes[status])
-      n.Conn = conn
-      err = a.Send(n)
-    default:
-      conn.Connected = false
-      n.Error = errors.New("Unknown error")
-      n.Conn = conn
-      err = a.Send(n)
+  status := uint8(read[1])
+  identifier := int32(binary.BigEndian.Uint32(read[2:6]))
+  a.logResponse(ctx, read)
+  if status == 0 {
+    a.observe(start, 0, nil)
+    res.Confirmed = true
+    if a.OnDelivered != nil {
+      a.OnDelivered(n.Identifier)
     }
+    return nil
+  }
+  if status == 10 && identifier == n.Identifier {
+    // On shutdown the identifier is the last notification Apple
+    // accepted, so n was delivered and only the connection is lost.
+    a.observe(start, status, nil)
+    p.noteShutdown(conn)
+    res.Confirmed = true
+    return nil
   }
 
-  return err
+  n.Error = &APNSError{Status: status, Message: StatusMessage(status), Identifier: identifier, Token: redactToken(n.DeviceToken)}
+  n.Conn = conn
+  a.observe(start, status, n.Error)
+  // Apple closes the connection after any error response.
+  switch status {
+  case 1:
+    //1:   "Processing error"
+    // The fault is on Apple's side, so n is worth resending.
+    conn.Connected = false
+  case 10:
+    // Apple is shutting the connection down after an earlier
+    // notification, without having accepted n.
+    p.noteShutdown(conn)
+  default:
+    //2:   "Missing Device Token",
+    //3:   "Missing Topic",
+    //4:   "Missing Payload",
+    //5:   "Invalid Token Size",
+    //6:   "Invalid Topic Size",
+    //7:   "Invalid Payload Size",
+    //8:   "Invalid Token",
+    // Apple rejected n itself and would reject it again, so the caller
+    // gets the rejection at once, e.g. to prune an invalid token.
+    conn.Connected = false
+    return n.Error
+  }
+  return a.send(ctx, n, res)
+}
+
+// observe reports a send attempt that started writing at start to the
+// client's Metrics, if any.
+func (a *APNSClient) observe(start time.Time, status uint8, err error) {
+  if a.Metrics != nil {
+    a.Metrics.ObserveSend(time.Since(start), status, err)
+  }
+}
+
+// Reap reconnects the pool's dropped idle connections using ctx; see
+// APNSPool.Reap. Run it periodically to keep the pool warm.
+func (a *APNSClient) Reap(ctx appengine.Context) error {
+  p, err := initPool(a)
+  if err != nil {
+    return err
+  }
+  return p.Reap(ctx)
+}
+
+// Warmup builds the client's pool and connects every idle connection with
+// ctx, a few handshakes at a time, so the first real send doesn't pay for
+// them. Connections that are already connected are skipped, which makes
+// repeated calls cheap. It returns the first connect error, if any. Call
+// it during instance startup; WarmupAndVerify also proves the send path
+// works.
+func (a *APNSClient) Warmup(ctx appengine.Context) error {
+  if a.DryRun {
+    return nil
+  }
+  return a.Reap(ctx)
+}
+
+// Pool returns the client's connection pool, building it if no send has
+// yet, e.g. to pin a connection with GetPinned.
+func (a *APNSClient) Pool() (*APNSPool, error) {
+  return initPool(a)
 }
 
+// Stats returns a snapshot of the client's connection pool, or the zero
+// PoolStats if no send has built it yet.
+func (a *APNSClient) Stats() PoolStats {
+  poolMu.Lock()
+  p := pools[a.poolKey()]
+  poolMu.Unlock()
+  if p == nil {
+    return PoolStats{}
+  }
+  return p.Stats()
+}
+
+// backoff sleeps before a resend, for RetryBackoff doubled per retry
+// already consumed and jittered by up to half, but no later than the
+// context deadline. It returns the context's error if the context ends.
+func (a *APNSClient) backoff(ctx appengine.Context, consumed int) error {
+  d := a.RetryBackoff
+  if d <= 0 {
+    d = defaultRetryBackoff
+  }
+  for i := 1; i < consumed && d < maxRetryBackoff; i++ {
+    d *= 2
+  }
+  if d > maxRetryBackoff {
+    d = maxRetryBackoff
+  }
+  d -= time.Duration(rand.Int63n(int64(d)/2 + 1))
+  if deadline, ok := contextDeadline(ctx); ok && time.Until(deadline) < d {
+    d = time.Until(deadline)
+  }
+  time.Sleep(d)
+  return contextErr(ctx)
+}
+
+// maxRetries returns MaxRetries, or the default of 3 when it is unset.
+func (a *APNSClient) maxRetries() int {
+  if a.MaxRetries > 0 {
+    return a.MaxRetries
+  }
+  return defaultMaxRetries
+}
+
+// handshakeRetries returns HandshakeRetries, the default of 2 when it is
+// unset, or 0 when it is negative.
+func (a *APNSClient) handshakeRetries() int {
+  switch {
+  case a.HandshakeRetries > 0:
+    return a.HandshakeRetries
+  case a.HandshakeRetries < 0:
+    return 0
+  }
+  return defaultHandshakeRetries
+}
+
+// readTimeout returns ReadTimeout, or the default of 150ms when it is
+// unset.
+func (a *APNSClient) readTimeout() time.Duration {
+  if a.ReadTimeout > 0 {
+    return a.ReadTimeout
+  }
+  return defaultReadTimeout
+}
+
+// writeTimeout returns WriteTimeout, or the default of 5 seconds when it
+// is unset.
+func (a *APNSClient) writeTimeout() time.Duration {
+  if a.WriteTimeout > 0 {
+    return a.WriteTimeout
+  }
+  return defaultWriteTimeout
+}
+
+// poolWaitTimeout returns PoolWaitTimeout, or the default of 5 seconds
+// when it is unset.
+func (a *APNSClient) poolWaitTimeout() time.Duration {
+  if a.PoolWaitTimeout > 0 {
+    return a.PoolWaitTimeout
+  }
+  return defaultPoolWaitTimeout
+}
+
+// applyDefaults fills in the client-wide defaults n doesn't set itself.
+func (a *APNSClient) applyDefaults(n *PushNotification) {
+  n.maxPayload = a.MaxPayloadBytes
+  if n.maxPayload <= 0 {
+    n.maxPayload = defaultMaxPayloadBytes
+  }
+  if a.DefaultExpiration > 0 && n.Expiry == 0 && !n.expirySet {
+    n.Expiry = uint32(time.Now().Add(a.DefaultExpiration).Unix())
+  }
+}
+
+// initPool returns the pool for a's gateway and certificate, building it
+// on first use.
+func initPool(a *APNSClient) (*APNSPool, error) {
+  poolMu.Lock()
+  defer poolMu.Unlock()
+  key := a.poolKey()
+  if p, ok := pools[key]; ok {
+    return p, nil
+  }
+  p, err := newAPNSPool(a)
+  if err != nil {
+    return nil, err
+  }
+  pools[key] = p
+  return p, nil
+}
+
+// Close closes every connection of the client's pool and discards it, so
+// the next send through a client with the same gateway and certificate
+// builds a fresh pool. Pools of other clients are left alone.
+func (a *APNSClient) Close() error {
+  poolMu.Lock()
+  key := a.poolKey()
+  p := pools[key]
+  delete(pools, key)
+  poolMu.Unlock()
+
+  if p == nil {
+    return nil
+  }
+  return p.CloseAll(a.Ctx)
+}
+
+// ResetPool closes every client's pool and discards them all, so the next
+// send through any client builds a fresh pool and reloads its
+// certificate, e.g. after rotating it or between tests. It is safe to
+// call while sends are in flight; their connections are closed when
+// released, and a warning about them is logged through ctx. The errors
+// from closing the connections are joined together.
+func ResetPool(ctx appengine.Context) error {
+  poolMu.Lock()
+  old := pools
+  pools = map[poolKey]*APNSPool{}
+  poolMu.Unlock()
+
+  var errs []error
+  for _, p := range old {
+    errs = append(errs, p.CloseAll(ctx))
+  }
+  return errors.Join(errs...)
+}
+
+// isReadTimeout reports whether err means no response arrived before the
+// read deadline, which on the binary protocol signals success. A context
+// that ended during the wait isn't one: context.DeadlineExceeded also
+// reports Timeout, but the wait was cut short.
+func isReadTimeout(err error) bool {
+  if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+    return false
+  }
+  if err2, ok := err.(net.Error); ok && err2.Timeout() {
+    return true
+  }
+  // App Engine sockets report an expired deadline this way.
+  return err.Error() == "API error 1 (remote_socket: SYSTEM_ERROR): system_error:35 error_detail:\"Resource temporarily unavailable\""
+}
+
+// logResponse logs a response from Apple as hex when Debug is set.
+func (a *APNSClient) logResponse(ctx appengine.Context, read [6]byte) {
+  if !a.Debug {
+    return
+  }
+  a.logger(ctx).Debugf("APNS response % x: status %d (%s), identifier %d", read[:], read[1], StatusMessage(read[1]), int32(binary.BigEndian.Uint32(read[2:6])))
+}
+
+// logFailure logs the redacted payload of a notification that could not
+// be delivered, together with the error that ended the send.
+func (a *APNSClient) logFailure(ctx appengine.Context, n *PushNotification, sendErr error) {
+  payload, err := n.redactedPayloadJSON(a.RedactKeys)
+  if err != nil {
+    a.logger(ctx).Errorf("APNS send to %s failed: %v (payload unavailable: %v)", redactToken(n.DeviceToken), sendErr, err)
+    return
+  }
+  a.logger(ctx).Errorf("APNS send to %s failed: %v, payload: %s", redactToken(n.DeviceToken), sendErr, payload)
+}
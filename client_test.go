@@ -0,0 +1,728 @@
+package apns
+
+import (
+  "context"
+  "crypto/tls"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "runtime"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "appengine"
+)
+
+// testToken is a syntactically valid device token.
+var testToken = strings.Repeat("ab", deviceTokenLength)
+
+// fakeGateway is an in-memory APNs gateway. Each connection the client
+// dials is a net.Pipe whose server side completes the TLS handshake and is
+// then handed to serve along with the dial number, starting at 1. The raw
+// pipe is closed when serve returns, without a close_notify, the way a
+// gateway drops a connection.
+type fakeGateway struct {
+  t     *testing.T
+  cert  tls.Certificate
+  dials int32
+  serve func(dial int, conn *tls.Conn)
+}
+
+// newFakeGateway returns a gateway serving connections with serve and
+// points a's Dialer at it.
+func newFakeGateway(t *testing.T, a *APNSClient, serve func(dial int, conn *tls.Conn)) *fakeGateway {
+  cert, err := LoadPem(testPem(t), "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  g := &fakeGateway{t: t, cert: cert, serve: serve}
+  a.Dialer = g.dial
+  a.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+  return g
+}
+
+func (g *fakeGateway) dial(ctx appengine.Context, network, addr string) (net.Conn, error) {
+  client, server := net.Pipe()
+  dial := int(atomic.AddInt32(&g.dials, 1))
+  go func() {
+    defer server.Close()
+    conn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{g.cert}})
+    if err := conn.Handshake(); err != nil {
+      return
+    }
+    g.serve(dial, conn)
+  }()
+  return client, nil
+}
+
+// Dials returns how many connections the client has dialed.
+func (g *fakeGateway) Dials() int {
+  return int(atomic.LoadInt32(&g.dials))
+}
+
+// readFrame reads one command 2 frame and returns its identifier.
+func readFrame(r io.Reader) (int32, error) {
+  var header [5]byte
+  if _, err := io.ReadFull(r, header[:]); err != nil {
+    return 0, err
+  }
+  frame := make([]byte, binary.BigEndian.Uint32(header[1:]))
+  if _, err := io.ReadFull(r, frame); err != nil {
+    return 0, err
+  }
+  var identifier int32
+  for len(frame) >= 3 {
+    size := int(binary.BigEndian.Uint16(frame[1:3]))
+    if frame[0] == notificationIdentifierItemid {
+      identifier = int32(binary.BigEndian.Uint32(frame[3 : 3+size]))
+    }
+    frame = frame[3+size:]
+  }
+  return identifier, nil
+}
+
+// respond writes an error response.
+func respond(w io.Writer, status uint8, identifier int32) error {
+  resp := [6]byte{8, status}
+  binary.BigEndian.PutUint32(resp[2:], uint32(identifier))
+  _, err := w.Write(resp[:])
+  return err
+}
+
+// serveSilently reads frames without answering, the way Apple accepts
+// notifications, until the connection closes.
+func serveSilently(dial int, conn *tls.Conn) {
+  for {
+    if _, err := readFrame(conn); err != nil {
+      return
+    }
+  }
+}
+
+func TestSendShutdownAfterDelivery(t *testing.T) {
+  a := newTestClient(t)
+  var frames int32
+  g := newFakeGateway(t, a, func(dial int, conn *tls.Conn) {
+    identifier, err := readFrame(conn)
+    if err != nil {
+      return
+    }
+    atomic.AddInt32(&frames, 1)
+    respond(conn, 10, identifier)
+  })
+
+  res, err := a.Deliver(NewPushNotificationTo(testToken).SetAlert("hi"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !res.Confirmed {
+    t.Error("delivery before the shutdown was not confirmed")
+  }
+  if got := atomic.LoadInt32(&frames); got != 1 || g.Dials() != 1 {
+    t.Errorf("got %d frames over %d dials, want the notification sent once", got, g.Dials())
+  }
+}
+
+func TestSendShutdownBeforeDelivery(t *testing.T) {
+  a := newTestClient(t)
+  a.RetryBackoff = time.Millisecond
+  g := newFakeGateway(t, a, func(dial int, conn *tls.Conn) {
+    if dial > 1 {
+      serveSilently(dial, conn)
+      return
+    }
+    identifier, err := readFrame(conn)
+    if err != nil {
+      return
+    }
+    respond(conn, 10, identifier-1)
+  })
+
+  if err := a.Send(NewPushNotificationTo(testToken).SetAlert("hi")); err != nil {
+    t.Fatal(err)
+  }
+  if g.Dials() != 2 {
+    t.Errorf("got %d dials, want the notification resent on a new connection", g.Dials())
+  }
+}
+
+func TestClientsHaveIndependentPools(t *testing.T) {
+  pem := testPem(t)
+  production := &APNSClient{Ctx: testContext{t}, PemBytes: pem, Gateway: GatewayProduction + ":" + PortDefault}
+  sandbox := &APNSClient{Ctx: testContext{t}, PemBytes: pem, Gateway: GatewaySandbox + ":" + PortDefault, PoolSize: 2}
+  defer production.Close()
+  defer sandbox.Close()
+
+  p1, err := production.Pool()
+  if err != nil {
+    t.Fatal(err)
+  }
+  p2, err := sandbox.Pool()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if p1 == p2 {
+    t.Fatal("clients for different gateways share a pool")
+  }
+  if got := p2.Stats().Capacity; got != 2 {
+    t.Errorf("sandbox pool has %d connections, want its own PoolSize of 2", got)
+  }
+  conn := p1.Get()
+  if conn.Gateway != production.Gateway {
+    t.Errorf("production pool dials %s", conn.Gateway)
+  }
+  p1.Release(conn)
+
+  production.Close()
+  conn = p2.Get()
+  if conn == nil {
+    t.Fatal("closing one client closed the other's pool")
+  }
+  p2.Release(conn)
+}
+
+func TestSharedPoolUsesEachClientsReadTimeout(t *testing.T) {
+  fast := newTestClient(t)
+  fast.ReadTimeout = 10 * time.Millisecond
+  newFakeGateway(t, fast, serveSilently)
+  slow := &APNSClient{Ctx: fast.Ctx, PemBytes: fast.PemBytes, Gateway: fast.Gateway, TLSConfig: fast.TLSConfig, Dialer: fast.Dialer}
+  slow.ReadTimeout = 300 * time.Millisecond
+
+  p1, _ := fast.Pool()
+  p2, _ := slow.Pool()
+  if p1 != p2 {
+    t.Fatal("clients with the same settings don't share a pool")
+  }
+
+  for _, a := range []*APNSClient{fast, slow, fast} {
+    start := time.Now()
+    if err := a.Send(NewPushNotificationTo(testToken).SetAlert("hi")); err != nil {
+      t.Fatal(err)
+    }
+    elapsed := time.Since(start)
+    if elapsed < a.ReadTimeout || elapsed > a.ReadTimeout+200*time.Millisecond {
+      t.Errorf("send with ReadTimeout %v waited %v", a.ReadTimeout, elapsed)
+    }
+  }
+}
+
+func TestWarmupAndVerifySkipsBusyConnections(t *testing.T) {
+  a := newTestClient(t)
+  a.PoolSize = 2
+  newFakeGateway(t, a, func(dial int, conn *tls.Conn) {
+    if identifier, err := readFrame(conn); err == nil {
+      respond(conn, 8, identifier)
+    }
+  })
+  p, err := a.Pool()
+  if err != nil {
+    t.Fatal(err)
+  }
+  busy := p.Get()
+  defer p.Release(busy)
+
+  done := make(chan error, 1)
+  go func() { done <- a.WarmupAndVerify() }()
+  select {
+  case err := <-done:
+    if err != nil {
+      t.Fatal(err)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatal("WarmupAndVerify waited for a checked-out connection")
+  }
+}
+
+func TestSendErrorsNameTheToken(t *testing.T) {
+  a := newTestClient(t)
+  a.RetryBackoff = time.Millisecond
+  newFakeGateway(t, a, func(dial int, conn *tls.Conn) {
+    if identifier, err := readFrame(conn); err == nil {
+      respond(conn, 8, identifier)
+    }
+  })
+
+  err := a.Send(NewPushNotificationTo(testToken).SetAlert("hi"))
+  var apnsErr *APNSError
+  if !errors.As(err, &apnsErr) || apnsErr.Status != 8 {
+    t.Fatalf("got %v, want an *APNSError with status 8", err)
+  }
+  if !strings.Contains(err.Error(), redactToken(testToken)) {
+    t.Errorf("error %q doesn't name the token", err)
+  }
+
+  a.SilentPolicy = SilentReject
+  err = a.Send(NewPushNotificationTo(testToken).SetAlert("hi").SetContentAvailable(true))
+  if !errors.Is(err, ErrMixedSilentPush) || !strings.Contains(err.Error(), redactToken(testToken)) {
+    t.Errorf("got %v, want ErrMixedSilentPush naming the token", err)
+  }
+}
+
+// serveThenHangUp reads one frame and drops the connection unanswered.
+func serveThenHangUp(dial int, conn *tls.Conn) {
+  readFrame(conn)
+}
+
+func TestSendRedialsAfterEOF(t *testing.T) {
+  a := newTestClient(t)
+  a.PoolSize = 1
+  a.RetryBackoff = time.Millisecond
+  g := newFakeGateway(t, a, func(dial int, conn *tls.Conn) {
+    if dial == 1 {
+      serveThenHangUp(dial, conn)
+      return
+    }
+    serveSilently(dial, conn)
+  })
+
+  if err := a.Send(NewPushNotificationTo(testToken).SetAlert("hi")); err != nil {
+    t.Fatal(err)
+  }
+  if g.Dials() != 2 {
+    t.Errorf("got %d dials, want the retry on a fresh socket", g.Dials())
+  }
+  if stats := a.Stats(); stats.Reconnects != 1 {
+    t.Errorf("got %d reconnects, want 1", stats.Reconnects)
+  }
+}
+
+func TestBrokenConnectionIsNotPooled(t *testing.T) {
+  a := newTestClient(t)
+  a.PoolSize = 1
+  newFakeGateway(t, a, serveThenHangUp)
+
+  n := NewPushNotificationTo(testToken).SetAlert("hi")
+  n.RetryCount = 1
+  if err := a.Send(n); err == nil {
+    t.Fatal("send over a connection that hung up succeeded")
+  }
+  p, _ := a.Pool()
+  conn := p.Get()
+  defer p.Release(conn)
+  if conn.Connected || conn.TlsConn != nil {
+    t.Error("the connection that hit EOF went back into the pool open")
+  }
+}
+
+func TestReadTimeoutsDontLeakGoroutines(t *testing.T) {
+  a := newTestClient(t)
+  a.PoolSize = 1
+  a.ReadTimeout = time.Millisecond
+  newFakeGateway(t, a, serveSilently)
+
+  send := func() {
+    if err := a.Send(NewPushNotificationTo(testToken).SetAlert("hi")); err != nil {
+      t.Fatal(err)
+    }
+  }
+  // The first send dials and starts the gateway's goroutine.
+  send()
+  before := runtime.NumGoroutine()
+  for i := 0; i < 100; i++ {
+    send()
+  }
+  if after := runtime.NumGoroutine(); after > before {
+    t.Errorf("goroutines grew from %d to %d over 100 timed out reads", before, after)
+  }
+}
+
+func TestFailedPoolBuildIsNotCached(t *testing.T) {
+  a := &APNSClient{Ctx: testContext{t}, PemBytes: []byte("not a certificate"), Gateway: "gateway.test:2195"}
+  defer a.Close()
+  for i := 0; i < 2; i++ {
+    if err := a.Send(NewPushNotificationTo(testToken).SetAlert("hi")); !errors.Is(err, ErrNoCertificate) {
+      t.Fatalf("send %d: got %v, want ErrNoCertificate", i+1, err)
+    }
+  }
+  if stats := a.Stats(); stats.Capacity != 0 {
+    t.Errorf("a pool was cached after the build failed: %+v", stats)
+  }
+}
+
+func TestRejectionIsNotRetried(t *testing.T) {
+  a := newTestClient(t)
+  a.RetryBackoff = time.Second
+  var frames int32
+  g := newFakeGateway(t, a, func(dial int, conn *tls.Conn) {
+    if identifier, err := readFrame(conn); err == nil {
+      atomic.AddInt32(&frames, 1)
+      respond(conn, 8, identifier)
+    }
+  })
+
+  start := time.Now()
+  err := a.Send(NewPushNotificationTo(testToken).SetAlert("hi"))
+  var apnsErr *APNSError
+  if !errors.As(err, &apnsErr) || apnsErr.Status != 8 {
+    t.Fatalf("got %v, want an *APNSError with status 8", err)
+  }
+  if got := atomic.LoadInt32(&frames); got != 1 || g.Dials() != 1 {
+    t.Errorf("got %d frames over %d dials, want a single attempt", got, g.Dials())
+  }
+  if elapsed := time.Since(start); elapsed >= a.RetryBackoff/2 {
+    t.Errorf("rejection took %v, want no backoff", elapsed)
+  }
+}
+
+func TestProcessingErrorIsRetried(t *testing.T) {
+  a := newTestClient(t)
+  a.RetryBackoff = time.Millisecond
+  g := newFakeGateway(t, a, func(dial int, conn *tls.Conn) {
+    if dial > 1 {
+      serveSilently(dial, conn)
+      return
+    }
+    if identifier, err := readFrame(conn); err == nil {
+      respond(conn, 1, identifier)
+    }
+  })
+
+  if err := a.Send(NewPushNotificationTo(testToken).SetAlert("hi")); err != nil {
+    t.Fatal(err)
+  }
+  if g.Dials() != 2 {
+    t.Errorf("got %d dials, want the notification resent after the processing error", g.Dials())
+  }
+}
+
+func TestSendSyncProcessingErrorIsUnknown(t *testing.T) {
+  for _, tt := range []struct {
+    status uint8
+    want   SyncResult
+  }{{1, SyncUnknown}, {8, SyncRejected}} {
+    a := newTestClient(t)
+    a.RetryBackoff = time.Millisecond
+    newFakeGateway(t, a, func(dial int, conn *tls.Conn) {
+      if identifier, err := readFrame(conn); err == nil {
+        respond(conn, tt.status, identifier)
+      }
+    })
+
+    got, err := a.SendSync(NewPushNotificationTo(testToken).SetAlert("hi"))
+    if got != tt.want || err == nil {
+      t.Errorf("status %d: got %v, %v, want %v with the error", tt.status, got, err, tt.want)
+    }
+  }
+}
+
+// deadlineContext is a testContext with a deadline.
+type deadlineContext struct {
+  testContext
+  deadline time.Time
+}
+
+func (c deadlineContext) Deadline() (time.Time, bool) { return c.deadline, true }
+
+func TestContextDeadlineIsNotSuccess(t *testing.T) {
+  a := newTestClient(t)
+  a.ReadTimeout = 2 * time.Second
+  newFakeGateway(t, a, serveSilently)
+
+  ctx := deadlineContext{testContext{t}, time.Now().Add(200 * time.Millisecond)}
+  err := a.SendCtx(ctx, NewPushNotificationTo(testToken).SetAlert("hi"))
+  if !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("send cut short by the context: got %v, want context.DeadlineExceeded", err)
+  }
+
+  ctx = deadlineContext{testContext{t}, time.Now().Add(-time.Second)}
+  err = a.SendCtx(ctx, NewPushNotificationTo(testToken).SetAlert("hi"))
+  if !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("send after the deadline: got %v, want context.DeadlineExceeded", err)
+  }
+}
+
+// testBatch returns count notifications to distinct tokens.
+func testBatch(count int) []*PushNotification {
+  notifications := make([]*PushNotification, count)
+  for i := range notifications {
+    notifications[i] = NewPushNotificationTo(strings.Repeat(fmt.Sprintf("%02x", i), deviceTokenLength)).SetAlert("hi")
+  }
+  return notifications
+}
+
+// identifiers records the identifiers a gateway receives.
+type identifiers struct {
+  mu   sync.Mutex
+  list []int32
+}
+
+func (r *identifiers) add(identifier int32) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.list = append(r.list, identifier)
+}
+
+func (r *identifiers) get() []int32 {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  return append([]int32(nil), r.list...)
+}
+
+// rejectSecond serves the first connection by rejecting the second frame
+// of a batch after reading count frames, and the others silently,
+// recording the identifiers they receive in resent.
+func rejectSecond(count int, resent *identifiers) func(dial int, conn *tls.Conn) {
+  return func(dial int, conn *tls.Conn) {
+    if dial > 1 {
+      for {
+        identifier, err := readFrame(conn)
+        if err != nil {
+          return
+        }
+        resent.add(identifier)
+      }
+    }
+    var rejected int32
+    for i := 0; i < count; i++ {
+      identifier, err := readFrame(conn)
+      if err != nil {
+        return
+      }
+      if i == 1 {
+        rejected = identifier
+      }
+    }
+    respond(conn, 8, rejected)
+  }
+}
+
+func TestBatchResubmissionKeepsIndexes(t *testing.T) {
+  a := newTestClient(t)
+  a.PoolSize = 1
+  a.IdentifierFunc = func(n *PushNotification, index int) int32 { return int32(100 + index) }
+  resent := &identifiers{}
+  newFakeGateway(t, a, rejectSecond(4, resent))
+
+  res, err := a.SendBatch(testBatch(4))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(res.Failed) != 1 || res.Failed[0].Identifier != 101 {
+    t.Fatalf("got failures %+v, want identifier 101 rejected", res.Failed)
+  }
+  if got := resent.get(); len(got) != 2 || got[0] != 102 || got[1] != 103 {
+    t.Errorf("resent identifiers %v, want [102 103]", got)
+  }
+}
+
+func TestBatchReadsRejectionAfterFailedWrite(t *testing.T) {
+  a := newTestClient(t)
+  a.PoolSize = 1
+  // The gateway stops reading after two frames, so the third write times
+  // out with the rejection waiting to be read.
+  a.WriteTimeout = 50 * time.Millisecond
+  resent := &identifiers{}
+  newFakeGateway(t, a, rejectSecond(2, resent))
+
+  notifications := testBatch(4)
+  res, err := a.SendBatch(notifications)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(res.Failed) != 1 || res.Failed[0].Notification != notifications[1] {
+    t.Fatalf("got failures %+v, want the second notification rejected", res.Failed)
+  }
+  for _, n := range res.Delivered {
+    if n == notifications[1] {
+      t.Error("the rejected notification was reported delivered")
+    }
+  }
+  if got := resent.get(); len(res.Delivered) != 3 || len(got) != 2 {
+    t.Errorf("got %d delivered after resending %d, want 3 after resending 2", len(res.Delivered), len(got))
+  }
+}
+
+func TestDryRunNeverDials(t *testing.T) {
+  a := newTestClient(t)
+  a.DryRun = true
+  var frames int32
+  a.OnDryRun = func(*PushNotification, []byte) { atomic.AddInt32(&frames, 1) }
+  g := newFakeGateway(t, a, serveSilently)
+
+  res, err := a.SendBatch(testBatch(3))
+  if err != nil || len(res.Delivered) != 3 {
+    t.Fatalf("SendBatch: got %+v, %v", res, err)
+  }
+  tokens := []string{testToken, strings.Repeat("cd", deviceTokenLength)}
+  if failed := a.SendMulti(tokens, NewPushNotification().SetAlert("hi")); len(failed) != 0 {
+    t.Errorf("SendMulti: %v", failed)
+  }
+  if _, err := a.Broadcast(a.Ctx, NewPushNotification().SetAlert("hi"), tokens, BroadcastOptions{}); err != nil {
+    t.Errorf("Broadcast: %v", err)
+  }
+  if err := a.Warmup(a.Ctx); err != nil {
+    t.Errorf("Warmup: %v", err)
+  }
+  if err := a.WarmupAndVerify(); err != nil {
+    t.Errorf("WarmupAndVerify: %v", err)
+  }
+  if g.Dials() != 0 {
+    t.Errorf("got %d dials in dry run mode", g.Dials())
+  }
+  if got := atomic.LoadInt32(&frames); got != 7 {
+    t.Errorf("OnDryRun got %d frames, want 7", got)
+  }
+}
+
+func TestBatchesRejectMixedSilentPush(t *testing.T) {
+  a := newTestClient(t)
+  g := newFakeGateway(t, a, serveSilently)
+  for _, policy := range []SilentPolicy{SilentReject, SilentSplit} {
+    a.SilentPolicy = policy
+    mixed := func() *PushNotification {
+      return NewPushNotificationTo(testToken).SetAlert("hi").SetContentAvailable(true)
+    }
+    if _, err := a.SendBatch([]*PushNotification{mixed()}); !errors.Is(err, ErrMixedSilentPush) {
+      t.Errorf("SendBatch under policy %d: got %v, want ErrMixedSilentPush", policy, err)
+    }
+    failed := a.SendMulti([]string{testToken}, mixed())
+    if !errors.Is(failed[testToken], ErrMixedSilentPush) {
+      t.Errorf("SendMulti under policy %d: got %v, want ErrMixedSilentPush", policy, failed)
+    }
+    if _, err := a.Broadcast(a.Ctx, mixed(), []string{testToken}, BroadcastOptions{}); !errors.Is(err, ErrMixedSilentPush) {
+      t.Errorf("Broadcast under policy %d: got %v, want ErrMixedSilentPush", policy, err)
+    }
+  }
+  if g.Dials() != 0 {
+    t.Errorf("got %d dials for rejected pushes", g.Dials())
+  }
+}
+
+func TestWarmupConnectsInParallel(t *testing.T) {
+  a := newTestClient(t)
+  a.PoolSize = maxParallelConnects
+  g := newFakeGateway(t, a, serveSilently)
+  const dialDelay = 100 * time.Millisecond
+  dial := a.Dialer
+  a.Dialer = func(ctx appengine.Context, network, addr string) (net.Conn, error) {
+    time.Sleep(dialDelay)
+    return dial(ctx, network, addr)
+  }
+
+  start := time.Now()
+  if err := a.Warmup(a.Ctx); err != nil {
+    t.Fatal(err)
+  }
+  if g.Dials() != maxParallelConnects {
+    t.Errorf("got %d dials, want every connection connected", g.Dials())
+  }
+  if elapsed := time.Since(start); elapsed >= 2*dialDelay {
+    t.Errorf("warming up %d connections took %v, want the handshakes run in parallel", maxParallelConnects, elapsed)
+  }
+}
+
+func TestBroadcastSpreadsChunksOverThePool(t *testing.T) {
+  a := newTestClient(t)
+  a.PoolSize = multiConns
+  a.ReadTimeout = 10 * time.Millisecond
+  g := newFakeGateway(t, a, serveSilently)
+
+  tokens := make([]string, 0, 11)
+  for i := 0; i < 10; i++ {
+    tokens = append(tokens, strings.Repeat(fmt.Sprintf("%02x", i), deviceTokenLength))
+  }
+  tokens = append(tokens, "not hex")
+  var reports int
+  progress, err := a.Broadcast(a.Ctx, NewPushNotification().SetAlert("hi"), tokens, BroadcastOptions{
+    ChunkSize: 4,
+    Progress:  func(BroadcastProgress) { reports++ },
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if progress.Sent != 10 || progress.Failed != 1 || progress.Remaining != 0 || progress.Offset != len(tokens) {
+    t.Errorf("got progress %+v, want 10 sent and the invalid token failed", progress)
+  }
+  if reports != 3 {
+    t.Errorf("got %d progress reports, want one per chunk", reports)
+  }
+  if g.Dials() < 2 {
+    t.Errorf("got %d dials, want the chunks spread over several connections", g.Dials())
+  }
+}
+
+// recordingLogger records the messages logged through it.
+type recordingLogger struct {
+  mu       sync.Mutex
+  messages []string
+}
+
+func (l *recordingLogger) record(format string, args ...interface{}) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{})   { l.record(format, args...) }
+func (l *recordingLogger) Infof(format string, args ...interface{})    { l.record(format, args...) }
+func (l *recordingLogger) Warningf(format string, args ...interface{}) { l.record(format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...interface{})   { l.record(format, args...) }
+
+// recordingContext is an appengine.Context that records what it logs.
+type recordingContext struct {
+  *recordingLogger
+}
+
+func (c recordingContext) Criticalf(format string, args ...interface{}) { c.record(format, args...) }
+
+func TestStaleResponseIsLoggedThroughTheSendContext(t *testing.T) {
+  a := newTestClient(t)
+  a.PoolSize = 1
+  a.ReadTimeout = 10 * time.Millisecond
+  newFakeGateway(t, a, func(dial int, conn *tls.Conn) {
+    identifier, err := readFrame(conn)
+    if err != nil {
+      return
+    }
+    // Answer only after the send has given up waiting.
+    time.Sleep(50 * time.Millisecond)
+    respond(conn, 8, identifier)
+    readFrame(conn)
+  })
+
+  ctx := recordingContext{&recordingLogger{}}
+  if err := a.SendCtx(ctx, NewPushNotificationTo(testToken).SetAlert("hi")); err != nil {
+    t.Fatal(err)
+  }
+  // Releasing the connection again drains the late response.
+  time.Sleep(100 * time.Millisecond)
+  p, _ := a.Pool()
+  conn, _ := p.GetCtx(ctx)
+  p.release(ctx, conn)
+
+  ctx.mu.Lock()
+  defer ctx.mu.Unlock()
+  for _, msg := range ctx.messages {
+    if strings.Contains(msg, "discarding stale response") {
+      return
+    }
+  }
+  t.Errorf("stale response wasn't logged through the context: %q", ctx.messages)
+}
+
+func TestCloseWarnsThroughTheContext(t *testing.T) {
+  a := newTestClient(t)
+  ctx := recordingContext{&recordingLogger{}}
+  a.Ctx = ctx
+  p, err := a.Pool()
+  if err != nil {
+    t.Fatal(err)
+  }
+  conn := p.Get()
+  defer p.Release(conn)
+
+  a.Close()
+  ctx.mu.Lock()
+  defer ctx.mu.Unlock()
+  for _, msg := range ctx.messages {
+    if strings.Contains(msg, "still checked out") {
+      return
+    }
+  }
+  t.Errorf("closing with a connection checked out wasn't logged: %q", ctx.messages)
+}
@@ -0,0 +1,48 @@
+package apns
+
+import (
+  "time"
+
+  "appengine"
+)
+
+// DeadlinePolicy divides the time left before the context deadline between
+// the phases of a send, so no single phase can use up the whole request.
+// Each phase may use its fraction of the time remaining when it starts,
+// after RetryReserve has been held back for later attempts. A zero
+// fraction leaves that phase unlimited, and the policy has no effect when
+// the context has no deadline.
+type DeadlinePolicy struct {
+  Dial         float64
+  Handshake    float64
+  Write        float64
+  Read         float64
+  RetryReserve float64
+}
+
+// DefaultDeadlinePolicy is a reasonable split for App Engine requests.
+var DefaultDeadlinePolicy = DeadlinePolicy{
+  Dial:         0.25,
+  Handshake:    0.5,
+  Write:        0.25,
+  Read:         0.25,
+  RetryReserve: 0.5,
+}
+
+// timeout returns how long a phase with the given fraction may take, or
+// false if the phase isn't limited.
+func (p DeadlinePolicy) timeout(ctx appengine.Context, fraction float64) (time.Duration, bool) {
+  if fraction <= 0 {
+    return 0, false
+  }
+  deadline, ok := contextDeadline(ctx)
+  if !ok {
+    return 0, false
+  }
+  remaining := time.Until(deadline)
+  if remaining < 0 {
+    remaining = 0
+  }
+  usable := float64(remaining) * (1 - p.RetryReserve)
+  return time.Duration(usable * fraction), true
+}
@@ -0,0 +1,169 @@
+package apns
+
+import (
+  "bytes"
+  "crypto/tls"
+  "crypto/x509"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// Hosts of the APNs HTTP/2 provider API.
+const (
+  HTTP2HostProduction = "api.push.apple.com"
+  HTTP2HostSandbox    = "api.sandbox.push.apple.com"
+)
+
+// MaxHTTP2PayloadSizeBytes is the payload limit of the HTTP/2 API.
+const MaxHTTP2PayloadSizeBytes = 4096
+
+// HTTP2Error is a notification the HTTP/2 API rejected.
+type HTTP2Error struct {
+  // StatusCode is the HTTP :status of the response.
+  StatusCode int
+  // Reason is the reason Apple gave in the response body, such as
+  // "BadDeviceToken".
+  Reason     string
+  // ID is the apns-id Apple assigned to the notification.
+  ID         string
+}
+
+func (e *HTTP2Error) Error() string {
+  if e.Reason == "" {
+    return fmt.Sprintf("apns: HTTP/2 status %d", e.StatusCode)
+  }
+  return fmt.Sprintf("apns: HTTP/2 status %d: %s", e.StatusCode, e.Reason)
+}
+
+// SendHTTP2 delivers n through Apple's HTTP/2 provider API instead of the
+// deprecated binary protocol, using the same certificate, and returns the
+// apns-id Apple assigned to it. A rejection is returned as an
+// *HTTP2Error.
+//
+// Unlike the binary protocol, every notification gets an explicit answer,
+// and CollapseID is honored. The connection is kept open across calls.
+// It requires outbound sockets with HTTP/2 support (App Engine Flexible,
+// or the second generation runtimes); classic urlfetch cannot present a
+// client certificate.
+func (a *APNSClient) SendHTTP2(n *PushNotification) (string, error) {
+  if err := contextErr(a.Ctx); err != nil {
+    return "", err
+  }
+  client, topic, err := a.http2()
+  if err != nil {
+    return "", err
+  }
+
+  if _, err = decodeToken(n.DeviceToken); err != nil {
+    return "", err
+  }
+  if aps, ok := n.Get("aps").(*Payload); ok {
+    if err = aps.validate(); err != nil {
+      return "", err
+    }
+  }
+  a.applyDefaults(n)
+  payload, err := n.PayloadJSON()
+  if err != nil {
+    return "", err
+  }
+  if len(payload) > MaxHTTP2PayloadSizeBytes {
+    return "", fmt.Errorf("payload too large (%d bytes), the limit is %d", len(payload), MaxHTTP2PayloadSizeBytes)
+  }
+
+  url := "https://" + a.http2Host() + "/3/device/" + n.DeviceToken
+  req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+  if err != nil {
+    return "", err
+  }
+  req.Header.Set("Content-Type", "application/json")
+  if n.Topic != "" {
+    topic = n.Topic
+  }
+  if topic != "" {
+    req.Header.Set("apns-topic", topic)
+  }
+  req.Header.Set("apns-expiration", strconv.FormatUint(uint64(n.Expiry), 10))
+  if n.Priority != 0 {
+    req.Header.Set("apns-priority", strconv.Itoa(int(n.Priority)))
+  }
+  if n.CollapseID != "" {
+    req.Header.Set("apns-collapse-id", n.CollapseID)
+  }
+  req.Header.Set("apns-push-type", pushType(n))
+  if deadline, ok := contextDeadline(a.Ctx); ok {
+    client = &http.Client{Transport: client.Transport, Timeout: time.Until(deadline)}
+  }
+
+  resp, err := client.Do(req)
+  if err != nil {
+    return "", err
+  }
+  defer resp.Body.Close()
+  id := resp.Header.Get("apns-id")
+  if resp.StatusCode == http.StatusOK {
+    return id, nil
+  }
+
+  body, _ := ioutil.ReadAll(resp.Body)
+  var reason struct {
+    Reason string `json:"reason"`
+  }
+  json.Unmarshal(body, &reason)
+  return id, &HTTP2Error{StatusCode: resp.StatusCode, Reason: reason.Reason, ID: id}
+}
+
+// http2 returns the client's HTTP/2 client and the topic of its
+// certificate, building them on first use.
+func (a *APNSClient) http2() (*http.Client, string, error) {
+  a.http2Mu.Lock()
+  defer a.http2Mu.Unlock()
+  if a.http2Client != nil {
+    return a.http2Client, a.http2Topic, nil
+  }
+  crt, err := a.loadCertificate()
+  if err != nil {
+    return nil, "", err
+  }
+  if leaf, err := x509.ParseCertificate(crt.Certificate[0]); err == nil {
+    a.http2Topic = CertTopic(leaf)
+  }
+  cfg := &tls.Config{}
+  if a.TLSConfig != nil {
+    cfg = a.TLSConfig.Clone()
+  }
+  cfg.Certificates = []tls.Certificate{crt}
+  transport := &http.Transport{
+    TLSClientConfig:   cfg,
+    ForceAttemptHTTP2: true,
+  }
+  if a.Proxy != nil {
+    transport.Proxy = http.ProxyURL(a.Proxy)
+  }
+  a.http2Client = &http.Client{Transport: transport}
+  return a.http2Client, a.http2Topic, nil
+}
+
+// http2Host returns HTTP2Host, or the API host matching the client's
+// environment.
+func (a *APNSClient) http2Host() string {
+  if a.HTTP2Host != "" {
+    return a.HTTP2Host
+  }
+  if a.Environment() == EnvironmentSandbox {
+    return HTTP2HostSandbox
+  }
+  return HTTP2HostProduction
+}
+
+// pushType returns the apns-push-type header for n.
+func pushType(n *PushNotification) string {
+  if aps, ok := n.Get("aps").(*Payload); ok && aps.ContentAvailable == 1 && !aps.visible() {
+    return "background"
+  }
+  return "alert"
+}
@@ -0,0 +1,40 @@
+package apns
+
+import (
+  "appengine"
+)
+
+// Logger receives the package's log messages. appengine.Context implements
+// it, and is used when APNSClient.Logger is nil.
+type Logger interface {
+  Debugf(format string, args ...interface{})
+  Infof(format string, args ...interface{})
+  Warningf(format string, args ...interface{})
+  Errorf(format string, args ...interface{})
+}
+
+// nopLogger discards the messages of code running without a context or
+// Logger, such as closing a pool, rather than bypassing App Engine's log
+// viewer through the standard logger.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{})   {}
+func (nopLogger) Infof(format string, args ...interface{})    {}
+func (nopLogger) Warningf(format string, args ...interface{}) {}
+func (nopLogger) Errorf(format string, args ...interface{})   {}
+
+// pickLogger returns l if set, else ctx, else a logger that discards.
+func pickLogger(l Logger, ctx appengine.Context) Logger {
+  if l != nil {
+    return l
+  }
+  if ctx != nil {
+    return ctx
+  }
+  return nopLogger{}
+}
+
+// logger returns where the client logs for a send through ctx.
+func (a *APNSClient) logger(ctx appengine.Context) Logger {
+  return pickLogger(a.Logger, ctx)
+}
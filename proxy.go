@@ -0,0 +1,54 @@
+package apns
+
+import (
+  "bufio"
+  "encoding/base64"
+  "fmt"
+  "net"
+  "net/http"
+  "net/url"
+)
+
+// proxyAddr returns the host:port to dial for proxy, defaulting the port
+// to 8080.
+func proxyAddr(proxy *url.URL) string {
+  if proxy.Port() != "" {
+    return proxy.Host
+  }
+  return net.JoinHostPort(proxy.Hostname(), "8080")
+}
+
+// tunnel asks the HTTP proxy at the other end of conn to connect it to
+// addr with a CONNECT request. On success conn carries the raw stream to
+// addr, ready for the TLS handshake.
+func tunnel(conn net.Conn, proxy *url.URL, addr string) error {
+  if proxy.Scheme != "http" && proxy.Scheme != "" {
+    return fmt.Errorf("apns: unsupported proxy scheme %q", proxy.Scheme)
+  }
+
+  req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+  if proxy.User != nil {
+    password, _ := proxy.User.Password()
+    auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+    req += "Proxy-Authorization: Basic " + auth + "\r\n"
+  }
+  if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+    return err
+  }
+
+  br := bufio.NewReader(conn)
+  resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("apns: proxy refused CONNECT to %s: %s", addr, resp.Status)
+  }
+  // Apple only speaks after the client hello, so nothing past the
+  // response can have been read.
+  if br.Buffered() > 0 {
+    return fmt.Errorf("apns: proxy sent unexpected data after CONNECT to %s", addr)
+  }
+  return nil
+}
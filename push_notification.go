@@ -6,15 +6,40 @@ import (
   "encoding/hex"
   "encoding/json"
   "errors"
+  "fmt"
   "math/rand"
   "strconv"
+  "strings"
   "time"
 )
 
 // Push commands always start with command value 2.
 const pushCommandValue = 2
 
-// Your total notification payload cannot exceed 256 bytes.
+// Commands of the older simple and enhanced formats.
+const (
+  simpleCommandValue   = 0
+  enhancedCommandValue = 1
+)
+
+// Format is the binary wire format of a notification.
+type Format int
+
+const (
+  // FormatFramed is command 2, with framed items. It is the default and
+  // the only format that carries a priority.
+  FormatFramed Format = iota
+  // FormatEnhanced is command 1, carrying an identifier and expiry. Apple
+  // answers it with the same error response as FormatFramed.
+  FormatEnhanced
+  // FormatSimple is command 0, carrying only the token and payload. Apple
+  // never sends an error response for it, so Send doesn't wait for one.
+  FormatSimple
+)
+
+// MaxPayloadSizeBytes is the original 256 byte payload limit. Apple has
+// since raised it to 2048 bytes, which ToBytes enforces on its own;
+// sending through an APNSClient applies its MaxPayloadBytes instead.
 const MaxPayloadSizeBytes = 256
 
 // Every push notification gets a pseudo-unique identifier;
@@ -39,10 +64,55 @@ const (
 //
 // Alert is an interface here because it supports either a string
 // or a dictionary, represented within by an AlertDictionary struct.
+// Sound names a sound file, which may live in a subdirectory of the app
+// bundle (e.g. "sounds/alert.caf"); an empty Sound is omitted. For
+// critical alerts, CriticalSound is sent as the sound dictionary instead.
+//
+// The aps dictionary is always emitted as alert, badge, sound followed by
+// any other keys in alphabetical order. Keep new fields sorted after Sound
+// and mirrored in MarshalJSON to preserve this.
 type Payload struct {
   Alert interface{} `json:"alert,omitempty"`
   Badge int         `json:"badge,omitempty"`
   Sound string      `json:"sound,omitempty"`
+
+  CriticalSound *CriticalSound `json:"-"`
+
+  ContentAvailable int    `json:"content-available,omitempty"`
+  MutableContent   int    `json:"mutable-content,omitempty"`
+  ThreadID         string `json:"thread-id,omitempty"`
+}
+
+// MarshalJSON encodes the payload with CriticalSound, if set, under the
+// sound key in place of Sound.
+func (p Payload) MarshalJSON() ([]byte, error) {
+  aps := struct {
+    Alert interface{} `json:"alert,omitempty"`
+    Badge int         `json:"badge,omitempty"`
+    Sound interface{} `json:"sound,omitempty"`
+
+    ContentAvailable int    `json:"content-available,omitempty"`
+    MutableContent   int    `json:"mutable-content,omitempty"`
+    ThreadID         string `json:"thread-id,omitempty"`
+  }{
+    Alert:            p.Alert,
+    Badge:            p.Badge,
+    ContentAvailable: p.ContentAvailable,
+    MutableContent:   p.MutableContent,
+    ThreadID:         p.ThreadID,
+  }
+  if p.CriticalSound != nil {
+    aps.Sound = p.CriticalSound
+  } else if p.Sound != "" {
+    aps.Sound = p.Sound
+  }
+  return json.Marshal(aps)
+}
+
+// visible reports whether the payload shows anything to the user. The
+// badge is ignored since AddPayload always sets one.
+func (p *Payload) visible() bool {
+  return p.Alert != nil || p.Sound != "" || p.CriticalSound != nil
 }
 
 // NewPayload creates and returns a Payload structure.
@@ -50,6 +120,23 @@ func NewPayload() *Payload {
   return new(Payload)
 }
 
+// validate checks the fields Apple would otherwise reject after a round-trip.
+func (p *Payload) validate() error {
+  if p.CriticalSound != nil && p.CriticalSound.Name == "" {
+    return errors.New("critical sound name is empty")
+  }
+  return nil
+}
+
+// CriticalSound is the dictionary form of the sound key, used for
+// critical alerts. Name is passed through unchanged and may include a
+// subdirectory path.
+type CriticalSound struct {
+  Critical int     `json:"critical,omitempty"`
+  Name     string  `json:"name"`
+  Volume   float64 `json:"volume,omitempty"`
+}
+
 // AlertDictionary is a more complex notification payload.
 //
 // From the APN docs: "Use the ... alert dictionary in general only if you absolutely need to."
@@ -60,6 +147,8 @@ type AlertDictionary struct {
   LocKey       string   `json:"loc-key,omitempty"`
   LocArgs      []string `json:"loc-args,omitempty"`
   LaunchImage  string   `json:"launch-image,omitempty"`
+  TitleLocKey  string   `json:"title-loc-key,omitempty"`
+  TitleLocArgs []string `json:"title-loc-args,omitempty"`
 }
 
 // NewAlertDictionary creates and returns an AlertDictionary structure.
@@ -67,17 +156,77 @@ func NewAlertDictionary() *AlertDictionary {
   return new(AlertDictionary)
 }
 
+// ErrUnsupportedOnLegacy is returned when a notification uses a feature the
+// binary protocol cannot carry.
+var ErrUnsupportedOnLegacy = errors.New("apns: feature not supported by the binary protocol")
+
 // PushNotification is the wrapper for the Payload.
 // The length fields are computed in ToBytes() and aren't represented here.
 type PushNotification struct {
   Identifier  int32
+  // Expiry is the UNIX time after which Apple stops trying to deliver
+  // the notification, sent as item 4 of the frame. Zero means deliver
+  // immediately and discard if the device is offline. See SetExpiry.
   Expiry      uint32
+  // DeviceToken is the device token as the app reported it, 64 hex
+  // characters.
   DeviceToken string
   Payload     map[string]interface{}
+  // Priority is sent as item 5 of the frame: 10 (the default) delivers
+  // immediately, 5 lets the device save power and is required for
+  // background pushes.
   Priority    uint8
   RetryCount  int
   Error       error
   Conn        *APNSConn
+
+  // Format selects the wire format ToBytes produces, FormatFramed unless
+  // set, for older test servers and proxies.
+  Format      Format
+
+  // Environment marks which APNs environment DeviceToken belongs to. When
+  // set, Send refuses to use a certificate valid only for the other one.
+  Environment Environment
+
+  // CollapseID coalesces notifications with the same ID on the device.
+  // Only the HTTP/2 API supports it, see SendHTTP2; ToBytes rejects it with
+  // ErrUnsupportedOnLegacy rather than silently dropping it.
+  CollapseID  string
+
+  // Topic is the bundle ID the notification targets, for certificates
+  // valid for several apps. SendHTTP2 sends it as apns-topic, defaulting
+  // to the certificate's own topic. The binary protocol has no topic item
+  // and takes the topic from the certificate, so ToBytes rejects it with
+  // ErrUnsupportedOnLegacy.
+  Topic       string
+
+  // TrimAlertToFit shortens the alert body with an ellipsis when the
+  // payload would otherwise exceed the payload limit. Custom keys are
+  // never trimmed.
+  TrimAlertToFit bool
+
+  // expirySet records an explicit SetExpiry, so a zero Expiry can mean
+  // "don't store" rather than "use the client default".
+  expirySet   bool
+
+  // attempts is the RetryCount the current send started with.
+  attempts    int
+
+  // wait is how long the current send waits for Apple's response.
+  wait        time.Duration
+
+  // maxPayload is the payload limit of the client sending the
+  // notification, or zero for defaultMaxPayloadBytes.
+  maxPayload  int
+
+  // payload, when set, is the JSON payload to send in place of Payload:
+  // serialized once for all the copies SendMulti makes, or given to
+  // SendRaw.
+  payload     []byte
+
+  // frame caches the serialized notification across retries of one send
+  // so every attempt writes identical bytes.
+  frame       []byte
 }
 
 // NewPushNotification creates and returns a PushNotification structure.
@@ -87,10 +236,138 @@ func NewPushNotification() (pn *PushNotification) {
   pn.Payload = make(map[string]interface{})
   pn.Identifier = rand.New(rand.NewSource(time.Now().UnixNano())).Int31n(IdentifierUbound)
   pn.Priority = 10
-  pn.RetryCount = 3 // Retry at least 3 times before giving up
   return
 }
 
+// NewPushNotificationTo creates a PushNotification for the device with
+// the given hex token, ready to be filled in with the Set* methods:
+//
+//   pn := apns.NewPushNotificationTo(token).SetAlert("Hello").SetBadge(1)
+func NewPushNotificationTo(token string) *PushNotification {
+  pn := NewPushNotification()
+  pn.DeviceToken = token
+  return pn
+}
+
+// aps returns the "aps" payload section, creating it if needed.
+func (pn *PushNotification) aps() *Payload {
+  p, ok := pn.Get("aps").(*Payload)
+  if !ok {
+    p = NewPayload()
+    pn.Set("aps", p)
+  }
+  return p
+}
+
+// SetAlert sets the alert to a string or an *AlertDictionary.
+func (pn *PushNotification) SetAlert(alert interface{}) *PushNotification {
+  pn.aps().Alert = alert
+  return pn
+}
+
+// SetBadge sets the badge number. Zero clears the badge, using the same
+// -1 trick as AddPayload.
+func (pn *PushNotification) SetBadge(badge int) *PushNotification {
+  if badge == 0 {
+    badge = -1
+  }
+  pn.aps().Badge = badge
+  return pn
+}
+
+// SetSound sets the name of the sound file to play.
+func (pn *PushNotification) SetSound(name string) *PushNotification {
+  pn.aps().Sound = name
+  return pn
+}
+
+// SetCriticalSound sets the sound of a critical alert, sent in place of
+// the sound name.
+func (pn *PushNotification) SetCriticalSound(sound *CriticalSound) *PushNotification {
+  pn.aps().CriticalSound = sound
+  return pn
+}
+
+// SetContentAvailable marks the notification as a background update. A
+// notification with only this flag set is delivered silently.
+func (pn *PushNotification) SetContentAvailable(available bool) *PushNotification {
+  pn.aps().ContentAvailable = boolFlag(available)
+  return pn
+}
+
+// SetMutableContent lets a notification service extension modify the
+// notification before it is shown.
+func (pn *PushNotification) SetMutableContent(mutable bool) *PushNotification {
+  pn.aps().MutableContent = boolFlag(mutable)
+  return pn
+}
+
+// SetLocalizedAlert has the device render the alert from the app's
+// Localizable.strings entry locKey, formatted with args, in the user's
+// language. It switches the alert to the dictionary form, keeping a plain
+// string alert as the body; alerts without localization stay plain
+// strings.
+func (pn *PushNotification) SetLocalizedAlert(locKey string, args ...string) *PushNotification {
+  dict := pn.alertDictionary()
+  dict.LocKey = locKey
+  dict.LocArgs = args
+  return pn
+}
+
+// SetLocalizedTitle sets the alert title from the localized string
+// titleLocKey, formatted with args.
+func (pn *PushNotification) SetLocalizedTitle(titleLocKey string, args ...string) *PushNotification {
+  dict := pn.alertDictionary()
+  dict.TitleLocKey = titleLocKey
+  dict.TitleLocArgs = args
+  return pn
+}
+
+// SetActionLocKey sets the localized string used for the alert's action
+// button.
+func (pn *PushNotification) SetActionLocKey(key string) *PushNotification {
+  pn.alertDictionary().ActionLocKey = key
+  return pn
+}
+
+// alertDictionary returns the alert as a dictionary, converting a string
+// alert into one with that body.
+func (pn *PushNotification) alertDictionary() *AlertDictionary {
+  aps := pn.aps()
+  switch alert := aps.Alert.(type) {
+  case *AlertDictionary:
+    return alert
+  case string:
+    dict := &AlertDictionary{Body: alert}
+    aps.Alert = dict
+    return dict
+  }
+  dict := NewAlertDictionary()
+  aps.Alert = dict
+  return dict
+}
+
+// SetThreadID groups the notification on the device with the others
+// sharing the same thread ID. An empty ID omits the key.
+func (pn *PushNotification) SetThreadID(id string) *PushNotification {
+  pn.aps().ThreadID = id
+  return pn
+}
+
+// boolFlag encodes b the way aps flags are sent: 1, or omitted when false.
+func boolFlag(b bool) int {
+  if b {
+    return 1
+  }
+  return 0
+}
+
+// SetCustom sets a custom top-level payload key.
+func (pn *PushNotification) SetCustom(key string, value interface{}) *PushNotification {
+  pn.Set(key, value)
+  return pn
+}
+
 // AddPayload sets the "aps" payload section of the request. It also
 // has a hack described within to deal with specific zero values.
 func (pn *PushNotification) AddPayload(p *Payload) {
@@ -113,6 +390,60 @@ func (pn *PushNotification) AddPayload(p *Payload) {
   pn.Set("aps", p)
 }
 
+// SetExpiry sets when Apple stops trying to deliver the notification. A
+// zero time means Apple won't store it at all, overriding the client's
+// DefaultExpiration.
+func (pn *PushNotification) SetExpiry(t time.Time) {
+  pn.Expiry = 0
+  if !t.IsZero() {
+    pn.Expiry = uint32(t.Unix())
+  }
+  pn.expirySet = true
+}
+
+// copyFor returns a copy of pn addressed to token. The payload is shared,
+// so it must not be modified while the copy is in use.
+func (pn *PushNotification) copyFor(token string) *PushNotification {
+  c := *pn
+  c.DeviceToken = token
+  c.Error = nil
+  c.Conn = nil
+  c.frame = nil
+  return &c
+}
+
+// mixedSilent reports whether pn asks for a background update while also
+// showing an alert or playing a sound, which Apple may reject.
+func (pn *PushNotification) mixedSilent() bool {
+  aps, ok := pn.Get("aps").(*Payload)
+  return ok && aps.ContentAvailable == 1 && aps.visible()
+}
+
+// splitSilent separates a mixed notification into a visible notification
+// without content-available and a silent one carrying only the background
+// flag and the custom keys, sent at low priority as Apple requires.
+func (pn *PushNotification) splitSilent() (visible, silent *PushNotification) {
+  aps := pn.Get("aps").(*Payload)
+
+  visibleAps := *aps
+  visibleAps.ContentAvailable = 0
+  visible = pn.copyFor(pn.DeviceToken)
+  visible.Payload = make(map[string]interface{}, len(pn.Payload))
+  for k, v := range pn.Payload {
+    visible.Payload[k] = v
+  }
+  visible.Set("aps", &visibleAps)
+
+  silent = pn.copyFor(pn.DeviceToken)
+  silent.Payload = make(map[string]interface{}, len(pn.Payload))
+  for k, v := range pn.Payload {
+    silent.Payload[k] = v
+  }
+  silent.Set("aps", &Payload{ContentAvailable: 1})
+  silent.Priority = 5
+  return visible, silent
+}
+
 // Get returns the value of a payload key, if it exists.
 func (pn *PushNotification) Get(key string) interface{} {
   return pn.Payload[key]
@@ -124,29 +455,243 @@ func (pn *PushNotification) Set(key string, value interface{}) {
 }
 
 // PayloadJSON returns the current payload in JSON format.
+//
+// The output is deterministic: the aps dictionary follows the field order
+// of Payload and custom keys are emitted in sorted order, so the same
+// notification always produces the same bytes. Serialization goes through
+// encoding/json, so quotes, backslashes, control characters and non-ASCII
+// text in custom values are always escaped into valid JSON.
 func (pn *PushNotification) PayloadJSON() ([]byte, error) {
   return json.Marshal(pn.Payload)
 }
 
+// redactedPayloadJSON returns the payload in JSON format with the values
+// of the given top-level keys masked.
+func (pn *PushNotification) redactedPayloadJSON(keys []string) ([]byte, error) {
+  redacted := make(map[string]interface{}, len(pn.Payload))
+  for k, v := range pn.Payload {
+    redacted[k] = v
+  }
+  for _, k := range keys {
+    if _, ok := redacted[k]; ok {
+      redacted[k] = "[REDACTED]"
+    }
+  }
+  return json.Marshal(redacted)
+}
+
+// redactToken shortens a hex device token to its first and last 4
+// characters so it can be logged for correlation.
+func redactToken(token string) string {
+  if len(token) <= 8 {
+    return strings.Repeat("*", len(token))
+  }
+  return token[:4] + "..." + token[len(token)-4:]
+}
+
 // PayloadString returns the current payload in string format.
 func (pn *PushNotification) PayloadString() (string, error) {
   j, err := pn.PayloadJSON()
   return string(j), err
 }
 
+// PayloadSize returns the size in bytes of the serialized aps and custom
+// JSON, which is exactly what Apple holds to the payload size limit; the
+// frame headers don't count. Nothing is sent; use it to trim alert text
+// before enqueuing the notification.
+func (pn *PushNotification) PayloadSize() (int, error) {
+  j, err := pn.PayloadJSON()
+  return len(j), err
+}
+
+// EstimatedSize is the same as PayloadSize.
+func (pn *PushNotification) EstimatedSize() (int, error) {
+  return pn.PayloadSize()
+}
+
 // ToBytes returns a byte array of the complete PushNotification
 // struct. This array is what should be transmitted to the APN Service.
+// A payload over the limit is rejected with an error giving its size.
 func (pn *PushNotification) ToBytes() ([]byte, error) {
-  token, err := hex.DecodeString(pn.DeviceToken)
+  frame, _, err := pn.toBytes()
+  return frame, err
+}
+
+// toBytes is ToBytes, also reporting whether the alert had to be trimmed.
+func (pn *PushNotification) toBytes() ([]byte, bool, error) {
+  if pn.CollapseID != "" || pn.Topic != "" {
+    return nil, false, ErrUnsupportedOnLegacy
+  }
+  token, err := decodeToken(pn.DeviceToken)
   if err != nil {
-    return nil, err
+    return nil, false, err
   }
-  payload, err := pn.PayloadJSON()
+  if pn.payload != nil {
+    frame, err := pn.encode(token, pn.payload)
+    return frame, false, err
+  }
+  if aps, ok := pn.Get("aps").(*Payload); ok {
+    if err = aps.validate(); err != nil {
+      return nil, false, err
+    }
+  }
+  payload, trimmed, err := pn.fittedPayloadJSON()
   if err != nil {
-    return nil, err
+    return nil, false, err
+  }
+  frame, err := pn.encode(token, payload)
+  return frame, trimmed, err
+}
+
+// encode writes token and payload in the notification's Format.
+func (pn *PushNotification) encode(token, payload []byte) ([]byte, error) {
+  switch pn.Format {
+  case FormatSimple, FormatEnhanced:
+    if err := checkItems(token, payload, pn.payloadLimit()); err != nil {
+      return nil, err
+    }
+    buffer := new(bytes.Buffer)
+    if pn.Format == FormatSimple {
+      binary.Write(buffer, binary.BigEndian, uint8(simpleCommandValue))
+    } else {
+      binary.Write(buffer, binary.BigEndian, uint8(enhancedCommandValue))
+      binary.Write(buffer, binary.BigEndian, uint32(pn.Identifier))
+      binary.Write(buffer, binary.BigEndian, pn.Expiry)
+    }
+    binary.Write(buffer, binary.BigEndian, uint16(len(token)))
+    binary.Write(buffer, binary.BigEndian, token)
+    binary.Write(buffer, binary.BigEndian, uint16(len(payload)))
+    binary.Write(buffer, binary.BigEndian, payload)
+    return buffer.Bytes(), nil
+  case FormatFramed:
+    return buildFrame(token, payload, uint32(pn.Identifier), pn.Expiry, pn.Priority, pn.payloadLimit())
   }
-  if len(payload) > MaxPayloadSizeBytes {
-    return nil, errors.New("payload is larger than the " + strconv.Itoa(MaxPayloadSizeBytes) + " byte limit")
+  return nil, fmt.Errorf("apns: unknown format %d", pn.Format)
+}
+
+// payloadLimit returns the largest payload the notification may carry.
+func (pn *PushNotification) payloadLimit() int {
+  if pn.maxPayload > 0 {
+    return pn.maxPayload
+  }
+  return defaultMaxPayloadBytes
+}
+
+// decodeToken decodes a hex device token as reported by the app, so a
+// malformed token fails before anything is sent rather than coming back
+// from Apple as "Invalid token size".
+func decodeToken(token string) ([]byte, error) {
+  b, err := hex.DecodeString(token)
+  if err != nil {
+    return nil, fmt.Errorf("invalid device token: %v", err)
+  }
+  if len(b) != deviceTokenLength {
+    return nil, fmt.Errorf("invalid device token: %d hex characters, want %d", len(token), 2*deviceTokenLength)
+  }
+  return b, nil
+}
+
+// fittedPayloadJSON returns the payload in JSON format. If it exceeds
+// the payload limit and TrimAlertToFit is set, the alert body is
+// shortened with an ellipsis until it fits; the notification itself is
+// left untouched.
+func (pn *PushNotification) fittedPayloadJSON() ([]byte, bool, error) {
+  payload, err := pn.PayloadJSON()
+  limit := pn.payloadLimit()
+  if err != nil || len(payload) <= limit || !pn.TrimAlertToFit {
+    return payload, false, err
+  }
+  aps, ok := pn.Get("aps").(*Payload)
+  if !ok {
+    return payload, false, nil
+  }
+
+  body := []rune(aps.alertBody())
+  trimmedAps := *aps
+  fitted := make(map[string]interface{}, len(pn.Payload))
+  for k, v := range pn.Payload {
+    fitted[k] = v
+  }
+  fitted["aps"] = &trimmedAps
+
+  for len(body) > 0 {
+    // Drop at least as many bytes as the payload is over, plus room
+    // for the ellipsis. Escaping may make this an underestimate, in
+    // which case the loop trims again.
+    cut := len(payload) - limit + len(ellipsis)
+    for cut > 0 && len(body) > 0 {
+      cut -= len(string(body[len(body)-1]))
+      body = body[:len(body)-1]
+    }
+    trimmedAps.setAlertBody(string(body) + ellipsis)
+    payload, err = json.Marshal(fitted)
+    if err != nil {
+      return nil, false, err
+    }
+    if len(payload) <= limit {
+      return payload, true, nil
+    }
+  }
+  return payload, false, nil
+}
+
+// ellipsis marks an alert body shortened by TrimAlertToFit.
+const ellipsis = "\u2026"
+
+// alertBody returns the text shown by the alert.
+func (p *Payload) alertBody() string {
+  switch alert := p.Alert.(type) {
+  case string:
+    return alert
+  case *AlertDictionary:
+    return alert.Body
+  }
+  return ""
+}
+
+// setAlertBody replaces the alert text, copying a dictionary alert so the
+// original is not modified.
+func (p *Payload) setAlertBody(body string) {
+  switch alert := p.Alert.(type) {
+  case string:
+    p.Alert = body
+  case *AlertDictionary:
+    dict := *alert
+    dict.Body = body
+    p.Alert = &dict
+  }
+}
+
+// BuildFrame returns the command 2 framed message for a notification, as
+// written to the gateway by ToBytes, for callers providing their own
+// transport. A zero expiration means Apple won't store the notification.
+// The payload may be up to 2048 bytes, the limit Send applies by default.
+func BuildFrame(token []byte, payload []byte, identifier uint32, expiration time.Time, priority uint8) ([]byte, error) {
+  var expiry uint32
+  if !expiration.IsZero() {
+    expiry = uint32(expiration.Unix())
+  }
+  return buildFrame(token, payload, identifier, expiry, priority, defaultMaxPayloadBytes)
+}
+
+// checkItems validates the token and payload sizes.
+func checkItems(token []byte, payload []byte, limit int) error {
+  if len(token) != deviceTokenLength {
+    return errors.New("device token must be " + strconv.Itoa(deviceTokenLength) + " bytes, got " + strconv.Itoa(len(token)))
+  }
+  if len(payload) == 0 {
+    return errors.New("payload is empty")
+  }
+  if len(payload) > limit {
+    return fmt.Errorf("payload too large (%d bytes), the limit is %d", len(payload), limit)
+  }
+  return nil
+}
+
+// buildFrame validates the item sizes and encodes the frame.
+func buildFrame(token []byte, payload []byte, identifier uint32, expiry uint32, priority uint8, limit int) ([]byte, error) {
+  if err := checkItems(token, payload, limit); err != nil {
+    return nil, err
   }
 
   frameBuffer := new(bytes.Buffer)
@@ -158,13 +703,13 @@ func (pn *PushNotification) ToBytes() ([]byte, error) {
   binary.Write(frameBuffer, binary.BigEndian, payload)
   binary.Write(frameBuffer, binary.BigEndian, uint8(notificationIdentifierItemid))
   binary.Write(frameBuffer, binary.BigEndian, uint16(notificationIdentifierLength))
-  binary.Write(frameBuffer, binary.BigEndian, pn.Identifier)
+  binary.Write(frameBuffer, binary.BigEndian, identifier)
   binary.Write(frameBuffer, binary.BigEndian, uint8(expirationDateItemid))
   binary.Write(frameBuffer, binary.BigEndian, uint16(expirationDateLength))
-  binary.Write(frameBuffer, binary.BigEndian, pn.Expiry)
+  binary.Write(frameBuffer, binary.BigEndian, expiry)
   binary.Write(frameBuffer, binary.BigEndian, uint8(priorityItemid))
   binary.Write(frameBuffer, binary.BigEndian, uint16(priorityLength))
-  binary.Write(frameBuffer, binary.BigEndian, pn.Priority)
+  binary.Write(frameBuffer, binary.BigEndian, priority)
 
   buffer := bytes.NewBuffer([]byte{})
   binary.Write(buffer, binary.BigEndian, uint8(pushCommandValue))
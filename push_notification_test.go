@@ -0,0 +1,142 @@
+package apns
+
+import (
+  "bytes"
+  "encoding/binary"
+  "encoding/json"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+// apsJSON serializes pn and returns its aps dictionary.
+func apsJSON(t *testing.T, pn *PushNotification) map[string]interface{} {
+  b, err := pn.PayloadJSON()
+  if err != nil {
+    t.Fatal(err)
+  }
+  var payload map[string]map[string]interface{}
+  if err := json.Unmarshal(b, &payload); err != nil {
+    t.Fatalf("invalid JSON %s: %v", b, err)
+  }
+  return payload["aps"]
+}
+
+func TestSound(t *testing.T) {
+  pn := NewPushNotificationTo(testToken)
+  pn.AddPayload(&Payload{Alert: "hi", Sound: ""})
+  if _, err := pn.ToBytes(); err != nil {
+    t.Fatalf("empty sound: %v", err)
+  }
+  if _, ok := apsJSON(t, pn)["sound"]; ok {
+    t.Error("empty sound was sent")
+  }
+
+  pn.SetSound("sounds/alert.caf")
+  if got := apsJSON(t, pn)["sound"]; got != "sounds/alert.caf" {
+    t.Errorf("got sound %v, want the path unchanged", got)
+  }
+
+  pn.SetCriticalSound(&CriticalSound{Critical: 1, Name: "sounds/critical.caf", Volume: 0.5})
+  want := map[string]interface{}{"critical": 1.0, "name": "sounds/critical.caf", "volume": 0.5}
+  got, _ := apsJSON(t, pn)["sound"].(map[string]interface{})
+  if len(got) != len(want) {
+    t.Fatalf("got critical sound %v, want %v", got, want)
+  }
+  for k, v := range want {
+    if got[k] != v {
+      t.Errorf("critical sound %s = %v, want %v", k, got[k], v)
+    }
+  }
+
+  pn.SetCriticalSound(&CriticalSound{Critical: 1})
+  if _, err := pn.ToBytes(); err == nil {
+    t.Error("critical sound without a name was accepted")
+  }
+}
+
+func TestBuildFramePayloadLimit(t *testing.T) {
+  token := make([]byte, deviceTokenLength)
+  payload := []byte(`{"aps":{"alert":"` + strings.Repeat("x", 1000) + `"}}`)
+  if _, err := BuildFrame(token, payload, 1, time.Time{}, 10); err != nil {
+    t.Errorf("payload Send accepts was rejected: %v", err)
+  }
+  payload = bytes.Repeat([]byte("x"), defaultMaxPayloadBytes+1)
+  if _, err := BuildFrame(token, payload, 1, time.Time{}, 10); err == nil {
+    t.Error("payload over 2048 bytes was accepted")
+  }
+}
+
+func TestToBytesPayloadLimit(t *testing.T) {
+  pn := NewPushNotificationTo(testToken).SetAlert("hi").SetCustom("data", strings.Repeat("x", 300))
+  if _, err := pn.ToBytes(); err != nil {
+    t.Errorf("payload Send accepts was rejected: %v", err)
+  }
+  pn.SetCustom("data", strings.Repeat("x", defaultMaxPayloadBytes))
+  if _, err := pn.ToBytes(); err == nil {
+    t.Error("payload over 2048 bytes was accepted")
+  }
+}
+
+// framePayload serializes pn with ToBytes and returns the payload item.
+func framePayload(t *testing.T, pn *PushNotification) []byte {
+  frame, err := pn.ToBytes()
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Command and frame length, then the token item.
+  item := frame[5+3+deviceTokenLength:]
+  if item[0] != payloadItemid {
+    t.Fatalf("got item %d, want the payload", item[0])
+  }
+  return item[3 : 3+binary.BigEndian.Uint16(item[1:3])]
+}
+
+func TestLocalizedAlertRoundTrip(t *testing.T) {
+  pn := NewPushNotificationTo(testToken).SetAlert("Hello")
+  var plain struct {
+    Aps struct {
+      Alert interface{} `json:"alert"`
+    } `json:"aps"`
+  }
+  if err := json.Unmarshal(framePayload(t, pn), &plain); err != nil {
+    t.Fatal(err)
+  }
+  if plain.Aps.Alert != "Hello" {
+    t.Errorf("got alert %v, want the plain string", plain.Aps.Alert)
+  }
+
+  pn.SetLocalizedAlert("GAME_INVITE", "Alice", "Chess").SetLocalizedTitle("INVITE_TITLE", "Alice").SetActionLocKey("PLAY")
+  var localized struct {
+    Aps struct {
+      Alert AlertDictionary `json:"alert"`
+    } `json:"aps"`
+  }
+  if err := json.Unmarshal(framePayload(t, pn), &localized); err != nil {
+    t.Fatal(err)
+  }
+  got := localized.Aps.Alert
+  if got.Body != "Hello" || got.LocKey != "GAME_INVITE" || strings.Join(got.LocArgs, ",") != "Alice,Chess" ||
+    got.TitleLocKey != "INVITE_TITLE" || strings.Join(got.TitleLocArgs, ",") != "Alice" || got.ActionLocKey != "PLAY" {
+    t.Errorf("got alert %+v", got)
+  }
+}
+
+func TestCustomValuesAreEscaped(t *testing.T) {
+  values := []string{`say "hi"`, `C:\path`, "two\nlines", "party 🎉", "<tag> & \u2028"}
+  pn := NewPushNotificationTo(testToken).SetAlert("hi")
+  for i, v := range values {
+    pn.SetCustom(strconv.Itoa(i), v)
+  }
+
+  var payload map[string]interface{}
+  if err := json.Unmarshal(framePayload(t, pn), &payload); err != nil {
+    t.Fatalf("payload is not valid JSON: %v", err)
+  }
+  for i, v := range values {
+    if got := payload[strconv.Itoa(i)]; got != v {
+      t.Errorf("custom value %q came back as %q", v, got)
+    }
+  }
+}
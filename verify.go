@@ -0,0 +1,94 @@
+package apns
+
+import (
+  "crypto/x509"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io"
+  "time"
+)
+
+// probeTimeout is how long WarmupAndVerify waits for Apple to answer the
+// probe notification.
+const probeTimeout = 2 * time.Second
+
+// probeToken is syntactically valid but never issued by Apple, so the
+// gateway answers it with status 8 (Invalid token).
+var probeToken = hex.EncodeToString(make([]byte, deviceTokenLength))
+
+// WarmupAndVerify connects every idle pooled connection and then sends a
+// probe notification to a token Apple is certain to reject. Getting the
+// expected "Invalid token" response proves the certificate, environment
+// and full send path work end to end, which a bare handshake doesn't. It
+// is meant for startup or readiness probes and returns a descriptive
+// error when the client isn't ready. Connections checked out by
+// concurrent sends are skipped, as in Reap; if every one is, it waits up
+// to PoolWaitTimeout for one to probe with.
+func (a *APNSClient) WarmupAndVerify() error {
+  if a.DryRun {
+    return nil
+  }
+  p, err := initPool(a)
+  if err != nil {
+    return fmt.Errorf("apns: not ready: %v", err)
+  }
+
+  conns := p.takeIdle()
+  defer func() {
+    for _, c := range conns {
+      p.release(a.Ctx, c)
+    }
+  }()
+  if len(conns) == 0 {
+    c, err := p.getWithin(a.Ctx, a.poolWaitTimeout())
+    if err != nil {
+      return fmt.Errorf("apns: not ready: %w", err)
+    }
+    conns = append(conns, c)
+  }
+  if c, err := connectAll(a.Ctx, conns); err != nil {
+    return fmt.Errorf("apns: not ready: connecting to %s: %v", c.Gateway, err)
+  }
+
+  conn := conns[0]
+  leaf, err := x509.ParseCertificate(conn.TlsCfg.Certificates[0].Certificate[0])
+  if err != nil {
+    return fmt.Errorf("apns: not ready: %v", err)
+  }
+  if err = checkCertValidity(leaf, time.Now()); err != nil {
+    return fmt.Errorf("apns: not ready: %v", err)
+  }
+  if env := a.Environment(); !conn.env.covers(env) {
+    return fmt.Errorf("apns: not ready: certificate is for %s but the gateway is %s", conn.env, env)
+  }
+
+  probe := NewPushNotification()
+  probe.DeviceToken = probeToken
+  probe.Set("aps", &Payload{})
+  frame, err := probe.ToBytes()
+  if err != nil {
+    return err
+  }
+  if err = conn.write(a.Ctx, frame, a.writeTimeout()); err != nil {
+    conn.Connected = false
+    return fmt.Errorf("apns: not ready: writing probe: %v", err)
+  }
+
+  read := [6]byte{}
+  conn.TlsConn.SetReadDeadline(time.Now().Add(probeTimeout))
+  _, err = io.ReadFull(conn.TlsConn, read[:])
+  // Apple closes the connection after answering the probe.
+  conn.Connected = false
+  switch {
+  case err == nil && read[1] == 8:
+    return nil
+  case err == nil:
+    return fmt.Errorf("apns: not ready: probe answered with status %d (%s)", read[1], StatusMessage(read[1]))
+  case isReadTimeout(err):
+    return errors.New("apns: not ready: no answer to probe notification")
+  case err == io.EOF:
+    return errors.New("apns: not ready: gateway closed the connection; the certificate may be revoked or for the wrong environment")
+  }
+  return fmt.Errorf("apns: not ready: reading probe response: %v", err)
+}